@@ -2,12 +2,14 @@
 export GOARCH=amd64
 
 tag=$(git describe  --tags)
+commit=$(git rev-parse --short HEAD)
+date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
 
 mkdir -p bin
 
 build(){
 	tmpdir=$(mktemp -d)
-	go build -ldflags "-X main.version=${tag}" -o $tmpdir/sshcode
+	go build -ldflags "-X main.version=${tag} -X main.commit=${commit} -X main.date=${date}" -o $tmpdir/sshcode
 
 	pushd $tmpdir
 	tarname=sshcode-$GOOS-$GOARCH.tar.gz
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+)
+
+// sshcodeConfigPath returns the default path of the sshcode config file, which
+// doesn't necessarily exist.
+func sshcodeConfigPath() (string, error) {
+	var path string
+	switch runtime.GOOS {
+	case "linux":
+		path = os.Getenv("XDG_CONFIG_HOME")
+		if path == "" {
+			path = os.ExpandEnv("$HOME/.config")
+		}
+	case "darwin":
+		path = os.ExpandEnv("$HOME/Library/Application Support")
+	case "windows":
+		path = os.Getenv("APPDATA")
+	default:
+		return "", xerrors.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+	return filepath.Join(path, "sshcode", "config"), nil
+}
+
+// configEntry is a flag set in the config file.
+type configEntry struct {
+	// host is the host argument the entry applies to, or empty for all hosts.
+	host  string
+	name  string
+	value string
+	line  int
+}
+
+// parseConfig parses a config file made of lines of the form "flag = value",
+// where flag is the long name of a command line flag. Entries following a line
+// of the form "[host]" only apply when connecting to host, those before any
+// such line to all hosts. Empty lines and lines starting with # are ignored.
+func parseConfig(r io.Reader) ([]configEntry, error) {
+	var (
+		entries []configEntry
+		host    string
+		sc      = bufio.NewScanner(r)
+	)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+			continue
+		case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+			host = strings.TrimSpace(text[1 : len(text)-1])
+			if host == "" {
+				return nil, xerrors.Errorf("line %v: missing host", line)
+			}
+			continue
+		}
+
+		i := strings.Index(text, "=")
+		if i < 0 {
+			return nil, xerrors.Errorf("line %v: expected flag = value, got %q", line, text)
+		}
+		entries = append(entries, configEntry{
+			host:  host,
+			name:  strings.TrimSpace(text[:i]),
+			value: strings.TrimSpace(text[i+1:]),
+			line:  line,
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// applyConfig sets the flags of the entries for host, and those for all hosts,
+// on fl. Flags given on the command line take precedence, and entries for host
+// over those for all hosts. A flag set for host replaces its entries for all
+// hosts, even one that can be given several times, like --forward, whose
+// entries within a section add up.
+func applyConfig(entries []configEntry, host string, fl *pflag.FlagSet) error {
+	given := make(map[string]bool)
+	fl.Visit(func(f *pflag.Flag) {
+		given[f.Name] = true
+	})
+
+	setForHost := make(map[string]bool)
+	for _, e := range entries {
+		if e.host == host {
+			setForHost[e.name] = true
+		}
+	}
+
+	// The entries for all hosts go first, as they did in the file.
+	var hostEntries []configEntry
+	for _, e := range entries {
+		if e.host == "" && !setForHost[e.name] {
+			hostEntries = append(hostEntries, e)
+		}
+	}
+	for _, e := range entries {
+		if e.host == host {
+			hostEntries = append(hostEntries, e)
+		}
+	}
+
+	for _, e := range hostEntries {
+		if fl.Lookup(e.name) == nil {
+			return xerrors.Errorf("line %v: unknown flag %q", e.line, e.name)
+		}
+		if given[e.name] {
+			continue
+		}
+		err := fl.Set(e.name, e.value)
+		if err != nil {
+			return xerrors.Errorf("line %v: invalid value for flag %q: %w", e.line, e.name, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig applies the config file at path for host to fl. A missing file is
+// only an error if required.
+func loadConfig(path string, required bool, host string, fl *pflag.FlagSet) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := parseConfig(f)
+	if err != nil {
+		return xerrors.Errorf("%v: %w", path, err)
+	}
+	err = applyConfig(entries, host, fl)
+	if err != nil {
+		return xerrors.Errorf("%v: %w", path, err)
+	}
+	return nil
+}
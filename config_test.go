@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfig(t *testing.T) {
+	const config = `
+# Defaults for every host.
+bind = :8443
+sync-exclude = globalStorage
+skipsync = true
+forward = 3000
+forward = 9229
+
+[kyle@dev.kwc.io]
+bind = :9000
+ssh-flags = -p 2222 -o "ServerAliveInterval 30"
+forward = 8080
+forward = 5432:5432
+
+[other.host]
+remote-port = 8080
+`
+	entries, err := parseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	newFlags := func(args ...string) (*rootCmd, *pflag.FlagSet) {
+		var c rootCmd
+		fl := pflag.NewFlagSet("sshcode", pflag.ContinueOnError)
+		c.RegisterFlags(fl)
+		require.NoError(t, fl.Parse(args))
+		return &c, fl
+	}
+
+	c, fl := newFlags()
+	require.NoError(t, applyConfig(entries, "kyle@dev.kwc.io", fl))
+	require.Equal(t, ":9000", c.bindAddr, "host entries take precedence")
+	require.Equal(t, `-p 2222 -o "ServerAliveInterval 30"`, c.sshFlags)
+	require.Equal(t, []string{"globalStorage"}, c.syncExcludes)
+	require.True(t, c.skipSync)
+	require.Equal(t, "", c.remotePort, "other hosts' entries don't apply")
+	require.Equal(t, []string{"8080", "5432:5432"}, c.forwards, "host entries replace lists for all hosts")
+
+	c, fl = newFlags()
+	require.NoError(t, applyConfig(entries, "other.host", fl))
+	require.Equal(t, []string{"3000", "9229"}, c.forwards, "entries within a section add up")
+
+	c, fl = newFlags("--bind", ":7000", "--skipsync=false")
+	require.NoError(t, applyConfig(entries, "kyle@dev.kwc.io", fl))
+	require.Equal(t, ":7000", c.bindAddr, "command line flags take precedence")
+	require.False(t, c.skipSync)
+
+	_, fl = newFlags()
+	entries, err = parseConfig(strings.NewReader("nope = 1"))
+	require.NoError(t, err)
+	require.Error(t, applyConfig(entries, "dev.kwc.io", fl))
+
+	_, err = parseConfig(strings.NewReader("bind :8443"))
+	require.Error(t, err)
+	_, err = parseConfig(strings.NewReader("[]\nbind = :8443"))
+	require.Error(t, err)
+}
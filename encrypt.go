@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// encryptedSettingsFiles are the files of the User dir that --encrypt-settings
+// transfers encrypted, as they're the ones extensions keep credentials in.
+var encryptedSettingsFiles = []string{"settings.json"}
+
+// syncEncryptedSettings transfers encryptedSettingsFiles between localDir and
+// remoteDir on host, encrypted with gpg for o.gpgRecipient. Files are encrypted
+// by the sending side and decrypted by the receiving one, so only ciphertext is
+// transferred. Files missing on the sending side are skipped.
+func syncEncryptedSettings(host string, localDir string, remoteDir string, back bool, o options) error {
+	if o.syncPreview || o.dryRun {
+		for _, name := range encryptedSettingsFiles {
+			flog.Info("%v would be transferred encrypted", name)
+		}
+		return nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "sshcode-settings")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range encryptedSettingsFiles {
+		var (
+			localPath  = filepath.Join(localDir, name)
+			remotePath = remoteDir + name
+			cipherPath = filepath.Join(tmpDir, name+".gpg")
+		)
+
+		if back {
+			err = pullEncrypted(host, remotePath, cipherPath, localPath, o)
+		} else {
+			err = pushEncrypted(host, localPath, cipherPath, remotePath, o)
+		}
+		if err != nil {
+			return xerrors.Errorf("failed to transfer %v encrypted: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pushEncrypted encrypts localPath to cipherPath, copies it to host and
+// decrypts it to remotePath there.
+func pushEncrypted(host string, localPath string, cipherPath string, remotePath string, o options) error {
+	if !pathExists(localPath) {
+		return nil
+	}
+
+	out, err := exec.Command("gpg", "--batch", "--yes", "--quiet", "--trust-model", "always",
+		"--recipient", o.gpgRecipient, "--output", cipherPath, "--encrypt", localPath,
+	).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to encrypt: %s: %w", out, err)
+	}
+
+	err = rsync(cipherPath, host+":"+remotePath+".gpg", o)
+	if err != nil {
+		return err
+	}
+
+	// remotePath is left unquoted for ~ to expand. The umask keeps the
+	// decrypted file private to the user.
+	_, err = runRemote(host, fmt.Sprintf(
+		"umask 077 && gpg --batch --yes --quiet --output %v --decrypt %v.gpg; status=$?; rm -f %v.gpg; exit $status",
+		remotePath, remotePath, remotePath,
+	), o)
+	if err != nil {
+		return xerrors.Errorf("failed to decrypt on remote host: %w", err)
+	}
+	return nil
+}
+
+// pullEncrypted encrypts remotePath on host, copies it to cipherPath and
+// decrypts it to localPath.
+func pullEncrypted(host string, remotePath string, cipherPath string, localPath string, o options) error {
+	out, err := runRemote(host, fmt.Sprintf(
+		"[ ! -f %v ] || { gpg --batch --yes --quiet --trust-model always --recipient %v --output %v.gpg --encrypt %v && echo encrypted; }",
+		remotePath, shellEscape(o.gpgRecipient), remotePath, remotePath,
+	), o)
+	if err != nil {
+		return xerrors.Errorf("failed to encrypt on remote host: %w", err)
+	}
+	if strings.TrimSpace(out) != "encrypted" {
+		return nil
+	}
+	defer func() {
+		_, err := runRemote(host, fmt.Sprintf("rm -f %v.gpg", remotePath), o)
+		if err != nil {
+			flog.Error("failed to remove encrypted %v from remote host: %v", remotePath, err)
+		}
+	}()
+
+	err = rsync(host+":"+remotePath+".gpg", cipherPath, o)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	decryptCmd := exec.Command("gpg", "--batch", "--quiet", "--decrypt", cipherPath)
+	decryptCmd.Stderr = &stderr
+	plaintext, err := decryptCmd.Output()
+	if err != nil {
+		return xerrors.Errorf("failed to decrypt: %s: %w", stderr.String(), err)
+	}
+	return ioutil.WriteFile(localPath, plaintext, 0600)
+}
+
+// runRemote runs the shell command cmd on host and returns its output.
+func runRemote(host string, cmd string, o options) (string, error) {
+	sshCmdStr := remoteCommand(o.sshFlags, host, cmd)
+
+	var stderr bytes.Buffer
+	sshCmd := shellCommand(sshCmdStr)
+	sshCmd.Stderr = &stderr
+	logCommand(o, sshCmd)
+	out, err := sshCmd.Output()
+	if err != nil {
+		return "", xerrors.Errorf("%s: %s: %w", sshCmdStr, stderr.String(), err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Errors describing the phase sshCode failed in. Errors returned by sshCode
+// are a *PhaseError with one of these where possible, so they can be checked
+// with xerrors.Is or xerrors.As. Those without a phase are invalid options.
+var (
+	// ErrResolveHost means the host argument couldn't be resolved, e.g. a
+	// cloud instance that doesn't exist.
+	ErrResolveHost = xerrors.New("host resolution failed")
+	// ErrConnect means the SSH connection to the host couldn't be established.
+	ErrConnect = xerrors.New("connection failed")
+	// ErrDownload means code-server couldn't be installed on the host.
+	ErrDownload = xerrors.New("download failed")
+	// ErrChecksum means the downloaded code-server didn't match its checksum.
+	ErrChecksum = xerrors.New("checksum verification failed")
+	// ErrSyncSettings means the VS Code settings couldn't be synced.
+	ErrSyncSettings = xerrors.New("settings sync failed")
+	// ErrSyncExtensions means the VS Code extensions couldn't be synced.
+	ErrSyncExtensions = xerrors.New("extensions sync failed")
+	// ErrStart means code-server or the tunnel to it couldn't be started.
+	ErrStart = xerrors.New("code-server start failed")
+	// ErrStartupTimeout means code-server didn't become reachable in time.
+	ErrStartupTimeout = xerrors.New("code-server startup timed out")
+	// ErrSessionEnded means the session ended without being asked to, e.g.
+	// because the connection dropped or code-server exited.
+	ErrSessionEnded = xerrors.New("session ended unexpectedly")
+)
+
+// sshConnectExitCode is the exit code ssh uses for its own errors, like
+// failing to connect or authenticate, as opposed to the remote command's.
+const sshConnectExitCode = 255
+
+// PhaseError is an error sshCode failed with in Phase, one of the errors
+// above. Its message and chain are those of Err.
+type PhaseError struct {
+	Phase error
+	Err   error
+}
+
+// withKind returns err as having happened in phase kind.
+func withKind(kind error, err error) error {
+	return &PhaseError{Phase: kind, Err: err}
+}
+
+func (e *PhaseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PhaseError) Is(target error) bool {
+	return target == e.Phase
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// isSSHConnectError reports whether err comes from an ssh command that exited
+// because of a connection failure.
+func isSSHConnectError(err error) bool {
+	var exitErr *exec.ExitError
+	return xerrors.As(err, &exitErr) && exitErr.ExitCode() == sshConnectExitCode
+}
+
+// permanentSSHErrors are messages of ssh failures that retrying won't fix.
+var permanentSSHErrors = []string{
+	"Permission denied",
+	"Could not resolve hostname",
+	"Host key verification failed",
+}
+
+// isPermanentSSHOutput reports whether the output of a failed ssh command
+// contains an error that retrying won't fix.
+func isPermanentSSHOutput(out string) bool {
+	for _, msg := range permanentSSHErrors {
+		if strings.Contains(out, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// permanentError marks an error that retrying won't fix, even if its kind
+// suggests otherwise.
+type permanentError struct {
+	err error
+}
+
+// permanent returns err marked as permanent.
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// isTransient reports whether retrying might fix err, such as a dropped
+// connection, as opposed to e.g. an invalid option or failed authentication.
+func isTransient(err error) bool {
+	var permErr *permanentError
+	if xerrors.As(err, &permErr) {
+		return false
+	}
+
+	for _, kind := range []error{ErrConnect, ErrDownload, ErrSyncSettings, ErrSyncExtensions, ErrStartupTimeout} {
+		if xerrors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestPhaseError(t *testing.T) {
+	cause := xerrors.New("curl: (6) Could not resolve host")
+	err := xerrors.Errorf("retried: %w", withKind(ErrDownload, xerrors.Errorf("failed to update code-server: %w", cause)))
+
+	require.Equal(t, "retried: failed to update code-server: curl: (6) Could not resolve host", err.Error(),
+		"the message is unchanged",
+	)
+	require.True(t, xerrors.Is(err, ErrDownload))
+	require.False(t, xerrors.Is(err, ErrConnect))
+	require.True(t, xerrors.Is(err, cause), "the chain is kept")
+
+	var phaseErr *PhaseError
+	require.True(t, xerrors.As(err, &phaseErr))
+	require.Equal(t, ErrDownload, phaseErr.Phase)
+
+	require.True(t, isTransient(err))
+	require.False(t, isTransient(permanent(err)))
+	require.False(t, isTransient(withKind(ErrSessionEnded, cause)))
+	require.False(t, isTransient(xerrors.New("invalid option")))
+}
+
+func TestIsSSHConnectError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exit codes come from sh")
+	}
+	exit := func(code int) error {
+		return exec.Command("sh", "-c", fmt.Sprintf("exit %v", code)).Run()
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection failure", exit(sshConnectExitCode), true},
+		{"wrapped connection failure", xerrors.Errorf("ssh: %w", exit(sshConnectExitCode)), true},
+		{"remote command failure", exit(1), false},
+		{"not an exit error", xerrors.New("exit status 255"), false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, isSSHConnectError(tt.err), tt.name)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	cause := xerrors.New("connection reset by peer")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connect", withKind(ErrConnect, cause), true},
+		{"download", withKind(ErrDownload, cause), true},
+		{"settings sync", withKind(ErrSyncSettings, cause), true},
+		{"extensions sync", withKind(ErrSyncExtensions, cause), true},
+		{"startup timeout", withKind(ErrStartupTimeout, cause), true},
+		{"wrapped", xerrors.Errorf("attempt 1: %w", withKind(ErrConnect, cause)), true},
+		{"permanent", permanent(withKind(ErrConnect, cause)), false},
+		{"wrapped permanent", xerrors.Errorf("attempt 1: %w", permanent(withKind(ErrConnect, cause))), false},
+		{"checksum", withKind(ErrChecksum, cause), false},
+		{"no phase", cause, false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, isTransient(tt.err), tt.name)
+	}
+}
+
+func TestIsPermanentSSHOutput(t *testing.T) {
+	tests := []struct {
+		out  string
+		want bool
+	}{
+		{"kyle@dev.kwc.io: Permission denied (publickey).", true},
+		{"ssh: Could not resolve hostname dev.kwc.io: Name or service not known", true},
+		{"Host key verification failed.", true},
+		{"ssh: connect to host dev.kwc.io port 22: Connection refused", false},
+		{"ssh: connect to host dev.kwc.io port 22: Operation timed out", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, isPermanentSSHOutput(tt.out), tt.out)
+	}
+}
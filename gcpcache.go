@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// gcpCacheFileEnv is the environment variable overriding where the addresses
+// gcp: hosts resolve to are cached.
+const gcpCacheFileEnv = "SSHCODE_GCP_CACHE"
+
+// defaultGCPCacheTTL is how long the address a gcp: host resolved to is used
+// before asking gcloud again.
+const defaultGCPCacheTTL = time.Hour
+
+// gcpCacheFile returns the path of the file caching what gcp: hosts resolved
+// to, as gcloud takes seconds to tell.
+func gcpCacheFile() (string, error) {
+	if env, ok := os.LookupEnv(gcpCacheFileEnv); ok {
+		return env, nil
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sshcode", "gcp.json"), nil
+}
+
+// gcpCacheEntry is what a gcp: host resolved to, as returned by
+// parseGCPSSHCmd.
+type gcpCacheEntry struct {
+	UserIP   string    `json:"userIP"`
+	SSHFlags string    `json:"sshFlags"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// readGCPCache reads the cached entries by instance from path. A missing file
+// means nothing is cached yet.
+func readGCPCache(path string) (map[string]gcpCacheEntry, error) {
+	cache := make(map[string]gcpCacheEntry)
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &cache)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse %v: %w", path, err)
+	}
+	return cache, nil
+}
+
+// writeGCPCache writes cache to path.
+func writeGCPCache(path string, cache map[string]gcpCacheEntry) error {
+	b, err := json.MarshalIndent(cache, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// cachedGCPHost returns the entry cached for instance, unless there is none or
+// it's older than ttl at now.
+func cachedGCPHost(path string, instance string, ttl time.Duration, now time.Time) (gcpCacheEntry, bool, error) {
+	cache, err := readGCPCache(path)
+	if err != nil {
+		return gcpCacheEntry{}, false, err
+	}
+	entry, ok := cache[instance]
+	if !ok || now.Sub(entry.Resolved) > ttl {
+		return gcpCacheEntry{}, false, nil
+	}
+	return entry, true, nil
+}
+
+// saveGCPHost caches entry for instance.
+func saveGCPHost(path string, instance string, entry gcpCacheEntry) error {
+	cache, err := readGCPCache(path)
+	if err != nil {
+		return err
+	}
+	cache[instance] = entry
+	return writeGCPCache(path, cache)
+}
+
+// forgetGCPHost drops the entry cached for instance, if any.
+func forgetGCPHost(path string, instance string) error {
+	cache, err := readGCPCache(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := cache[instance]; !ok {
+		return nil
+	}
+	delete(cache, instance)
+	return writeGCPCache(path, cache)
+}
+
+// resolveGCPHost resolves the gcp: instance like parseGCPSSHCmd, using what it
+// resolved to before for up to o.gcpCacheTTL unless o.gcpRefresh is set.
+// Failing to use the cache isn't fatal, gcloud is asked instead.
+func resolveGCPHost(instance string, o options) (userIP, sshFlags string, err error) {
+	if o.gcpCacheTTL <= 0 {
+		return parseGCPSSHCmd(instance)
+	}
+	path, err := gcpCacheFile()
+	if err != nil {
+		flog.Error("failed to find where to cache gcp: hosts: %v", err)
+		return parseGCPSSHCmd(instance)
+	}
+
+	if !o.gcpRefresh {
+		entry, ok, err := cachedGCPHost(path, instance, o.gcpCacheTTL, time.Now())
+		if err != nil {
+			flog.Error("failed to read cached gcp: host: %v", err)
+		} else if ok {
+			logInfo(o, "using the address of %v resolved %v ago, pass --gcp-refresh to resolve it again",
+				instance, time.Since(entry.Resolved).Round(time.Second),
+			)
+			return entry.UserIP, entry.SSHFlags, nil
+		}
+	}
+
+	userIP, sshFlags, err = parseGCPSSHCmd(instance)
+	if err != nil {
+		return "", "", err
+	}
+	err = saveGCPHost(path, instance, gcpCacheEntry{
+		UserIP:   userIP,
+		SSHFlags: sshFlags,
+		Resolved: time.Now(),
+	})
+	if err != nil {
+		flog.Error("failed to cache gcp: host: %v", err)
+	}
+	return userIP, sshFlags, nil
+}
+
+// forgetStaleGCPHost drops the cached address of host, the host argument,
+// when err, as returned by sshCode, shows it couldn't be connected to, e.g.
+// because the instance was restarted with another IP. That way the next
+// attempt asks gcloud again.
+func forgetStaleGCPHost(host string, o options, err error) {
+	host = withUser(host, o.user)
+	if !strings.HasPrefix(host, "gcp:") || o.gcpCacheTTL <= 0 {
+		return
+	}
+	if !xerrors.Is(err, ErrConnect) && !isSSHConnectError(err) {
+		return
+	}
+	path, err := gcpCacheFile()
+	if err != nil {
+		return
+	}
+	err = forgetGCPHost(path, strings.TrimPrefix(host, "gcp:"))
+	if err != nil {
+		flog.Error("failed to drop cached gcp: host: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCPCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sshcode", "gcp.json")
+
+	now := time.Now()
+	_, ok, err := cachedGCPHost(path, "dev", time.Hour, now)
+	require.NoError(t, err)
+	require.False(t, ok, "nothing is cached without a cache file")
+
+	entry := gcpCacheEntry{
+		UserIP:   "kyle@35.1.2.3",
+		SSHFlags: "-t -i ~/.ssh/google_compute_engine",
+		Resolved: now.Add(-30 * time.Minute),
+	}
+	require.NoError(t, saveGCPHost(path, "dev", entry))
+	require.NoError(t, saveGCPHost(path, "other", gcpCacheEntry{UserIP: "kyle@35.4.5.6", Resolved: now}))
+
+	got, ok, err := cachedGCPHost(path, "dev", time.Hour, now)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, entry.UserIP, got.UserIP)
+	require.Equal(t, entry.SSHFlags, got.SSHFlags)
+
+	_, ok, err = cachedGCPHost(path, "dev", 10*time.Minute, now)
+	require.NoError(t, err)
+	require.False(t, ok, "expired entries aren't used")
+
+	require.NoError(t, forgetGCPHost(path, "dev"))
+	_, ok, err = cachedGCPHost(path, "dev", time.Hour, now)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = cachedGCPHost(path, "other", time.Hour, now)
+	require.NoError(t, err)
+	require.True(t, ok, "other instances stay cached")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0600))
+	_, _, err = cachedGCPHost(path, "other", time.Hour, now)
+	require.Error(t, err)
+}
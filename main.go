@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
@@ -12,6 +13,7 @@ import (
 
 	"go.coder.com/cli"
 	"go.coder.com/flog"
+	"go.coder.com/retry"
 )
 
 func init() {
@@ -22,10 +24,17 @@ const helpTabWidth = 5
 
 var (
 	helpTab = strings.Repeat(" ", helpTabWidth)
-	// version is overwritten by ci/build.sh.
-	version string
+	// version, commit and date are overwritten by ci/build.sh.
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
 )
 
+// versionString describes the build for --version.
+func versionString(version, commit, date string) string {
+	return fmt.Sprintf("sshcode %v (commit %v, built %v, %v/%v)", version, commit, date, runtime.GOOS, runtime.GOARCH)
+}
+
 func main() {
 	cli.RunRoot(&rootCmd{})
 }
@@ -40,9 +49,83 @@ type rootCmd struct {
 	syncBack          bool
 	printVersion      bool
 	noReuseConnection bool
+	keepSession       bool
+	notify            bool
+	tls               bool
+	noDefaultExcludes bool
+	syncPreview       bool
+	pruneOldVersions  bool
 	bindAddr          string
+	remotePort        string
 	sshFlags          string
 	uploadCodeServer  string
+	syncDirection     string
+	maxSyncSize       string
+	chromeProfileDir  string
+	openBrowserCmd    string
+	windowName        string
+	jumpHost          string
+	jumpIdentity      string
+	remoteNice        int
+	remoteIonice      string
+	retries           int
+	envPassthrough    []string
+	warm              bool
+	resumeSync        bool
+	downloadURL       string
+	localBindOnly     bool
+	remoteAccessible  bool
+	syncTasks         bool
+	probeInterval     time.Duration
+	encryptSettings   bool
+	gpgRecipient      string
+	attach            bool
+	hostKeyChecking   string
+	dryRun            bool
+	verbose           bool
+	quiet             bool
+	codeServerVersion string
+	skipChecksum      bool
+	browser           string
+	startupTimeout    time.Duration
+	syncExcludes      []string
+	noDownload        bool
+	bindAll           bool
+	auth              bool
+	kill              bool
+	codeServerFlags   string
+	connectRetries    int
+	remoteCacheDir    string
+	configPath        string
+	onReady           string
+	noIncognito       bool
+	allowExtensions   bool
+	syncBackOnly      bool
+	noDelete          bool
+	vsCodeFlavor      string
+	json              bool
+	syncTimeout       time.Duration
+	sshBinary         string
+	extensions        []string
+	noOpen            bool
+	agentForward      bool
+	noKillExisting    bool
+	rsyncFlags        string
+	localPort         string
+	sessionName       string
+	skipSettings      bool
+	skipExtensions    bool
+	openFile          string
+	printURLOnly      bool
+	stopFile          string
+	insecureHostKey   bool
+	knownHosts        string
+	reconnect         int
+	forwards          []string
+	user              string
+	gcpCacheTTL       time.Duration
+	gcpRefresh        bool
+	userDataDir       string
 }
 
 func (c *rootCmd) Spec() cli.CommandSpec {
@@ -55,17 +138,92 @@ func (c *rootCmd) Spec() cli.CommandSpec {
 
 func (c *rootCmd) RegisterFlags(fl *pflag.FlagSet) {
 	fl.BoolVar(&c.skipSync, "skipsync", false, "skip syncing local settings and extensions to remote host")
+	fl.BoolVar(&c.skipSettings, "skip-settings", false, "skip syncing settings, in both directions")
+	fl.BoolVar(&c.skipExtensions, "skip-extensions", false, "skip syncing extensions, in both directions")
 	fl.BoolVar(&c.syncBack, "b", false, "sync extensions back on termination")
+	fl.BoolVar(&c.syncBackOnly, "sync-back-only", false, "only sync settings and extensions from the remote host back to local, without starting code-server")
+	fl.StringVar(&c.syncDirection, "sync-direction", syncPush, "direction of the sync on startup: push (local to remote), pull (remote to local) or both (push, then sync back on termination)")
+	fl.BoolVar(&c.noDelete, "no-delete", false, "don't delete files missing from the side synced from, only add and update files")
+	fl.StringVar(&c.vsCodeFlavor, "vscode-flavor", defaultVSCodeFlavor, "local VS Code to sync settings and extensions with, one of stable, insiders or oss")
+	fl.BoolVar(&c.json, "json", false, "print the session's URL, ports and PID as a line of JSON on stdout once code-server is ready, and everything else on stderr")
+	fl.BoolVar(&c.printURLOnly, "print-url-only", false, "don't open a browser, only print the URL on stdout once code-server is ready, and everything else on stderr, e.g. for scripts running sshcode in the background")
+	fl.StringVar(&c.stopFile, "stop-file", "", "end the session, like on SIGINT, once a file exists at this path, which is then removed")
+	fl.DurationVar(&c.syncTimeout, "sync-timeout", 0, "stop syncing settings or extensions if a single rsync takes longer than this, e.g. 10m (default no limit)")
+	fl.StringVar(&c.sshBinary, "ssh-binary", "ssh", "ssh compatible command to run the tunnel with, e.g. \"autossh -M 0\" to reconnect it when the connection drops")
+	fl.BoolVar(&c.noDefaultExcludes, "no-default-excludes", false, "also sync .git, .cache and *.log files in extensions")
+	fl.StringVar(&c.rsyncFlags, "rsync-flags", "", "extra rsync flags to sync with, e.g. \"--bwlimit=1000\", quoted like in a shell")
+	fl.StringSliceVar(&c.extensions, "extensions", nil, "comma separated IDs of the extensions to sync, e.g. ms-python.python, instead of all of them")
+	fl.StringSliceVar(&c.syncExcludes, "sync-exclude", nil, "rsync pattern of settings to leave out of the sync in addition to the built-in ones, can be repeated")
+	fl.BoolVar(&c.syncTasks, "sync-tasks", false, "also sync the user level tasks.json")
+	fl.BoolVar(&c.encryptSettings, "encrypt-settings", false, "transfer settings.json encrypted with gpg, see --gpg-recipient")
+	fl.StringVar(&c.gpgRecipient, "gpg-recipient", "", "gpg key to encrypt settings for with --encrypt-settings, its secret key must be available locally and on the remote host")
+	fl.BoolVar(&c.resumeSync, "resume-sync", false, "keep partially synced files so that an interrupted sync resumes where it left off")
+	fl.BoolVarP(&c.verbose, "verbose", "v", false, "also log the commands being run")
+	fl.BoolVarP(&c.quiet, "quiet", "q", false, "only log warnings, errors and what's needed to use code-server")
+	fl.BoolVar(&c.dryRun, "dry-run", false, "print the commands that would be run on the remote host instead of running them")
+	fl.BoolVar(&c.syncPreview, "sync-preview", false, "show what syncing settings and extensions would change, then exit without starting code-server")
+	fl.BoolVar(&c.pruneOldVersions, "prune-old-versions", false, "remove code-server binaries other than the current one from the remote cache once started")
+	fl.BoolVar(&c.warm, "warm", false, "skip downloading code-server and syncing if a previous run left code-server on the remote host")
+	fl.StringVar(&c.userDataDir, "user-data-dir", "", "remote directory for code-server's settings, extensions and state, relative to the home directory or absolute, which settings are synced to (default ~/.local/share/code-server)")
+	fl.StringVar(&c.sessionName, "session-name", "", "name of a session with settings, extensions and state of its own on the remote host, to keep concurrent sessions apart")
+	fl.BoolVar(&c.noKillExisting, "no-kill-existing", false, "don't stop a code-server left running on --remote-port before starting a new one")
+	fl.BoolVar(&c.kill, "kill", false, "stop code-server on the remote host instead of starting a session, only the one on --remote-port if given")
+	fl.BoolVar(&c.attach, "attach", false, "attach to a code-server already running on --remote-port instead of restarting it")
+	fl.StringVar(&c.configPath, "config", "", "config file to take default flags from (default: sshcode/config in your user config directory)")
 	fl.BoolVar(&c.printVersion, "version", false, "print version information and exit")
 	fl.BoolVar(&c.noReuseConnection, "no-reuse-connection", false, "do not reuse SSH connection via control socket")
+	fl.BoolVar(&c.keepSession, "keep-session", false, "keep code-server running on the remote host after disconnecting")
+	fl.BoolVar(&c.keepSession, "detach", false, "same as --keep-session")
+	fl.StringVar(&c.onReady, "on-ready", "", "shell command to run once code-server is ready, with its URL in $SSHCODE_URL and the host in $SSHCODE_HOST")
+	fl.BoolVar(&c.notify, "notify", false, "show a desktop notification when code-server is ready and when the session ends")
+	fl.BoolVar(&c.tls, "tls", false, "serve code-server over HTTPS with a self-signed certificate")
+	fl.BoolVar(&c.localBindOnly, "local-bind-only", false, "only reach code-server through the SSH tunnel, this is the default")
+	fl.BoolVar(&c.remoteAccessible, "remote-accessible", false, "make code-server listen on all interfaces of the remote host with password authentication, instead of tunneling it")
+	fl.BoolVar(&c.auth, "auth", false, "require a password to use code-server, taken from $"+passwordEnv+" or generated and printed on startup")
+	fl.BoolVar(&c.bindAll, "bind-all", false, "bind the local end of the SSH tunnel to all interfaces, exposing code-server to your network")
 	fl.StringVar(&c.bindAddr, "bind", "", "local bind address for SSH tunnel, in [HOST][:PORT] syntax (default: 127.0.0.1)")
+	fl.StringVar(&c.localPort, "local-port", "", "local port to reach code-server on, which the remote port is forwarded to (default: random)")
+	fl.StringVar(&c.remotePort, "remote-port", "", "remote port for code-server to listen on, 0 lets the remote host pick one (default: random)")
+	fl.StringVar(&c.maxSyncSize, "max-sync-size", "", "abort if a local directory to sync is larger than this, e.g. 500M or 2G (default: no limit)")
 	fl.StringVar(&c.sshFlags, "ssh-flags", "", "custom SSH flags")
+	fl.DurationVar(&c.gcpCacheTTL, "gcp-cache-ttl", defaultGCPCacheTTL, "how long to reuse the address a gcp: host resolved to instead of asking gcloud again, 0 to always ask")
+	fl.BoolVar(&c.gcpRefresh, "gcp-refresh", false, "ask gcloud for the address of a gcp: host even if it's cached")
+	fl.StringVar(&c.user, "user", "", "user to log in as, unless HOST names one, also for gcp:, aws:, azure: and do: hosts")
+	fl.BoolVar(&c.agentForward, "agent-forward", false, "forward your ssh-agent to the remote host, e.g. to pull private git repositories there")
+	fl.StringVar(&c.codeServerFlags, "code-server-flags", "", "extra flags to start code-server with, e.g. \"--disable-telemetry\"")
+	fl.StringVar(&c.openFile, "open-file", "", "file to open in code-server, relative to DIR, or a .code-workspace file to open as the workspace")
+	fl.BoolVar(&c.noOpen, "no-open", false, "don't open a browser, only print the URL once code-server is ready, e.g. on a headless machine")
+	fl.StringVar(&c.browser, "browser", "", "browser to open code-server in: chrome, firefox, edge or default for the system's default (default: chrome if installed)")
+	fl.BoolVar(&c.noIncognito, "no-incognito", false, "don't open Chrome in incognito mode, so that logins and other state are kept between runs")
+	fl.BoolVar(&c.allowExtensions, "allow-extensions", false, "don't disable Chrome extensions and plugins")
+	fl.StringVar(&c.chromeProfileDir, "chrome-profile-dir", "", "Chrome profile directory to open code-server in, e.g. \"Profile 1\"")
+	fl.StringVar(&c.openBrowserCmd, "open-browser-cmd", "", "shell command to open the URL with instead of detecting a browser, the URL is passed as $1 and replaces {{.URL}}")
+	fl.StringVar(&c.windowName, "window-name", "", "window class for the Chrome app window to tell sessions apart (Linux only)")
+	fl.BoolVar(&c.insecureHostKey, "insecure-host-key", false, "trust the host key of a new host without asking, for fresh cloud instances, same as --host-key-checking accept-new")
+	fl.StringVar(&c.knownHosts, "known-hosts", "", "known_hosts file to check and record host keys in (default: from your ssh config)")
+	fl.StringVar(&c.hostKeyChecking, "host-key-checking", "", "ssh host key checking policy: yes, no or accept-new, no also doesn't record host keys (default: from your ssh config)")
+	fl.StringVar(&c.jumpHost, "jump-host", "", "connect through this jump host, like ssh's -J")
+	fl.StringVar(&c.jumpIdentity, "jump-identity", "", "identity file for the jump host, if it differs from the target host's")
+	fl.IntVar(&c.remoteNice, "remote-nice", 0, "niceness to run code-server with on the remote host, from -20 to 19")
+	fl.StringVar(&c.remoteIonice, "remote-ionice", "", "I/O scheduling class to run code-server with on the remote host: realtime, best-effort or idle")
+	fl.StringSliceVar(&c.forwards, "forward", nil, "LOCAL_PORT:REMOTE_PORT to forward through the tunnel besides code-server's, e.g. for a dev server, can be repeated")
+	fl.StringSliceVar(&c.envPassthrough, "env-passthrough", nil, "name of a local environment variable to pass through to code-server, can be repeated")
+	fl.DurationVar(&c.startupTimeout, "startup-timeout", defaultStartupTimeout, "how long to wait for code-server to start, e.g. 1m")
+	fl.DurationVar(&c.probeInterval, "probe-interval", 250*time.Millisecond, "time to wait between checks whether code-server has started")
+	fl.IntVar(&c.connectRetries, "connect-retries", 3, "number of times to retry downloading code-server when the connection fails")
+	fl.IntVar(&c.reconnect, "reconnect", 0, "number of times to try re-establishing the tunnel when the connection drops during a session, e.g. after the laptop slept, before ending it")
+	fl.IntVar(&c.retries, "retries", 0, "number of times to retry on transient failures, such as a dropped connection")
+	fl.StringVar(&c.codeServerVersion, "code-server-version", "", "code-server version to install, e.g. v2.1692-vsc1.39.2 (default: latest)")
+	fl.BoolVar(&c.noDownload, "no-download", false, "use the code-server already on the remote host instead of downloading or updating it, for offline hosts")
+	fl.BoolVar(&c.skipChecksum, "skip-checksum", false, "don't verify the downloaded code-server against its published checksum")
+	fl.StringVar(&c.downloadURL, "download-url", os.Getenv(downloadURLEnv), "comma separated mirrors to download code-server from, tried in order before "+defaultDownloadURL+", can also be set with $"+downloadURLEnv)
+	fl.StringVar(&c.remoteCacheDir, "remote-cache-dir", defaultRemoteCacheDir, "directory on the remote host to install code-server in")
 	fl.StringVar(&c.uploadCodeServer, "upload-code-server", "", "custom code-server binary to upload to the remote host")
 }
 
 func (c *rootCmd) Run(fl *pflag.FlagSet) {
 	if c.printVersion {
-		fmt.Printf("%v\n", version)
+		fmt.Println(versionString(version, commit, date))
 		os.Exit(0)
 	}
 
@@ -76,7 +234,30 @@ func (c *rootCmd) Run(fl *pflag.FlagSet) {
 		os.Exit(1)
 	}
 
-	dir := fl.Arg(1)
+	var dir string
+	if isURLSpec(host) {
+		var err error
+		host, dir, err = parseURLSpec(host, fl)
+		if err != nil {
+			flog.Fatal("failed to parse %v: %v", fl.Arg(0), err)
+		}
+	}
+
+	configPath := c.configPath
+	if configPath == "" {
+		// Platforms without a default config path have no config to load.
+		configPath, _ = sshcodeConfigPath()
+	}
+	// Only a config file that was asked for has to exist.
+	if configPath != "" {
+		if err := loadConfig(configPath, c.configPath != "", host, fl); err != nil {
+			flog.Fatal("failed to load config: %v", err)
+		}
+	}
+
+	if fl.Arg(1) != "" {
+		dir = fl.Arg(1)
+	}
 	if dir == "" {
 		dir = "~"
 	}
@@ -86,14 +267,128 @@ func (c *rootCmd) Run(fl *pflag.FlagSet) {
 		dir = gitbashWindowsDir(dir)
 	}
 
-	err := sshCode(host, dir, options{
-		skipSync:         c.skipSync,
-		sshFlags:         c.sshFlags,
-		bindAddr:         c.bindAddr,
-		syncBack:         c.syncBack,
-		reuseConnection:  !c.noReuseConnection,
-		uploadCodeServer: c.uploadCodeServer,
-	})
+	var maxSyncSize int64
+	if c.maxSyncSize != "" {
+		var err error
+		maxSyncSize, err = parseByteSize(c.maxSyncSize)
+		if err != nil {
+			flog.Fatal("failed to parse max sync size: %v", err)
+		}
+	}
+
+	level := logNormal
+	switch {
+	case c.verbose && c.quiet:
+		flog.Fatal("--verbose and --quiet can't be used together")
+	case c.verbose:
+		level = logVerbose
+	case c.quiet:
+		level = logQuiet
+	}
+
+	o := options{
+		skipSync:          c.skipSync,
+		sshFlags:          c.sshFlags,
+		bindAddr:          c.bindAddr,
+		syncBack:          c.syncBack,
+		reuseConnection:   !c.noReuseConnection,
+		keepSession:       c.keepSession,
+		notify:            c.notify,
+		tls:               c.tls,
+		noDefaultExcludes: c.noDefaultExcludes,
+		syncPreview:       c.syncPreview,
+		pruneOldVersions:  c.pruneOldVersions,
+		remotePort:        c.remotePort,
+		uploadCodeServer:  c.uploadCodeServer,
+		syncDirection:     c.syncDirection,
+		maxSyncSize:       maxSyncSize,
+		chromeProfileDir:  c.chromeProfileDir,
+		openBrowserCmd:    c.openBrowserCmd,
+		windowName:        c.windowName,
+		jumpHost:          c.jumpHost,
+		jumpIdentity:      c.jumpIdentity,
+		remoteNice:        c.remoteNice,
+		remoteIonice:      c.remoteIonice,
+		envPassthrough:    c.envPassthrough,
+		warm:              c.warm,
+		resumeSync:        c.resumeSync,
+		downloadURL:       c.downloadURL,
+		localBindOnly:     c.localBindOnly,
+		remoteAccessible:  c.remoteAccessible,
+		syncTasks:         c.syncTasks,
+		probeInterval:     c.probeInterval,
+		encryptSettings:   c.encryptSettings,
+		gpgRecipient:      c.gpgRecipient,
+		attach:            c.attach,
+		hostKeyChecking:   c.hostKeyChecking,
+		dryRun:            c.dryRun,
+		logLevel:          level,
+		codeServerVersion: c.codeServerVersion,
+		skipChecksum:      c.skipChecksum,
+		browser:           c.browser,
+		startupTimeout:    c.startupTimeout,
+		syncExcludes:      c.syncExcludes,
+		noDownload:        c.noDownload,
+		bindAll:           c.bindAll,
+		auth:              c.auth,
+		kill:              c.kill,
+		codeServerFlags:   c.codeServerFlags,
+		connectRetries:    c.connectRetries,
+		remoteCacheDir:    c.remoteCacheDir,
+		onReady:           c.onReady,
+		noIncognito:       c.noIncognito,
+		allowExtensions:   c.allowExtensions,
+		syncBackOnly:      c.syncBackOnly,
+		noDelete:          c.noDelete,
+		vsCodeFlavor:      c.vsCodeFlavor,
+		syncTimeout:       c.syncTimeout,
+		sshBinary:         c.sshBinary,
+		extensions:        c.extensions,
+		noOpen:            c.noOpen,
+		agentForward:      c.agentForward,
+		noKillExisting:    c.noKillExisting,
+		rsyncFlags:        c.rsyncFlags,
+		localPort:         c.localPort,
+		sessionName:       c.sessionName,
+		skipSettings:      c.skipSettings,
+		skipExtensions:    c.skipExtensions,
+		openFile:          c.openFile,
+		printURLOnly:      c.printURLOnly,
+		stopFile:          c.stopFile,
+		insecureHostKey:   c.insecureHostKey,
+		knownHosts:        c.knownHosts,
+		reconnect:         c.reconnect,
+		forwards:          c.forwards,
+		user:              c.user,
+		gcpCacheTTL:       c.gcpCacheTTL,
+		gcpRefresh:        c.gcpRefresh,
+		userDataDir:       c.userDataDir,
+	}
+
+	if c.json || c.printURLOnly {
+		// Everything else sshcode and the commands it runs print goes to
+		// stderr, so that stdout only holds the status or URL.
+		if c.json {
+			o.statusOut = os.Stdout
+		} else {
+			o.urlOut = os.Stdout
+		}
+		os.Stdout = os.Stderr
+	}
+
+	backoff := &retry.Backoff{
+		Floor: 2 * time.Second,
+		Ceil:  time.Minute,
+	}
+	err := sshCode(host, dir, o)
+	forgetStaleGCPHost(host, o, err)
+	for attempt := 1; err != nil && attempt <= c.retries && isTransient(err); attempt++ {
+		flog.Error("error: %v", err)
+		flog.Info("retrying (%v/%v)...", attempt, c.retries)
+		_ = backoff.Wait(context.Background())
+		err = sshCode(host, dir, o)
+		forgetStaleGCPHost(host, o, err)
+	}
 
 	if err != nil {
 		flog.Fatal("error: %v", err)
@@ -114,11 +409,13 @@ Environment variables:
 More info: https://github.com/cdr/sshcode
 
 Arguments:
-%vHOST is passed into the ssh command. Valid formats are '<ip-address>' or 'gcp:<instance-name>'.
+%vHOST is passed into the ssh command. Valid formats are '<ip-address>', 'gcp:[<user>@]<instance-name>', 'aws:[<user>@]<instance-id-or-name>', 'azure:[<user>@][<resource-group>/]<vm-name>' or 'do:[<user>@]<droplet-name-or-id>'.
+%vHOST can also be a URL such as 'sshcode://user@host:port/dir?bind=:8443&skipsync=true', with options as query parameters.
 %vDIR is optional.`,
 		helpTab, vsCodeConfigDirEnv,
 		helpTab, vsCodeExtensionsDirEnv,
 		helpTab,
 		helpTab,
+		helpTab,
 	)
 }
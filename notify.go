@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"go.coder.com/flog"
+)
+
+// notify shows a desktop notification with the given title and message using
+// whichever notifier the platform has. Failures are logged, not returned, as a
+// missing notification should never end a session.
+func notify(title string, msg string) {
+	var notifyCmd *exec.Cmd
+
+	switch {
+	case commandExists("notify-send"):
+		notifyCmd = exec.Command("notify-send", title, msg)
+	case commandExists("osascript"):
+		script := fmt.Sprintf("display notification %q with title %q", msg, title)
+		notifyCmd = exec.Command("osascript", "-e", script)
+	case commandExists("powershell.exe"):
+		// Available from WSL, shows a Windows toast notification.
+		notifyCmd = exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command",
+			windowsToastScript(title, msg),
+		)
+	default:
+		flog.Error("failed to send notification: no notify-send, osascript or powershell.exe found")
+		return
+	}
+
+	out, err := notifyCmd.CombinedOutput()
+	if err != nil {
+		flog.Error("failed to send notification: %s: %v", out, err)
+	}
+}
+
+// windowsToastScript returns a PowerShell script showing a toast notification.
+func windowsToastScript(title string, msg string) string {
+	// PowerShell escapes single quotes in single quoted strings by doubling them.
+	quote := func(s string) string {
+		return "'" + strings.Replace(s, "'", "''", -1) + "'"
+	}
+
+	// Toasts need a registered app ID, so borrow PowerShell's.
+	const appID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+	return fmt.Sprintf(`[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode(%v)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode(%v)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(%v).Show([Windows.UI.Notifications.ToastNotification]::new($template))`,
+		quote(title), quote(msg), quote(appID),
+	)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+)
+
+// portStateFileEnv is the environment variable overriding where the remote
+// ports used for each host are remembered.
+const portStateFileEnv = "SSHCODE_PORT_STATE"
+
+// portStateFile returns the path of the file remembering the remote port last
+// used for each host, so that code-server keeps the same port across runs.
+func portStateFile() (string, error) {
+	if env, ok := os.LookupEnv(portStateFileEnv); ok {
+		return env, nil
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sshcode", "ports.json"), nil
+}
+
+// readPorts reads the remote ports by host from path. A missing file means no
+// ports are remembered yet.
+func readPorts(path string) (map[string]string, error) {
+	ports := make(map[string]string)
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ports, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &ports)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse %v: %w", path, err)
+	}
+	return ports, nil
+}
+
+// lastRemotePort returns the remote port last used for host, or an empty string
+// if there is none.
+func lastRemotePort(path string, host string) (string, error) {
+	ports, err := readPorts(path)
+	if err != nil {
+		return "", err
+	}
+	return ports[host], nil
+}
+
+// saveRemotePort remembers port as the remote port used for host.
+func saveRemotePort(path string, host string, port string) error {
+	ports, err := readPorts(path)
+	if err != nil {
+		return err
+	}
+	ports[host] = port
+
+	b, err := json.MarshalIndent(ports, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemotePortState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-ports")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sshcode", "ports.json")
+
+	port, err := lastRemotePort(path, "kyle@dev.kwc.io")
+	require.NoError(t, err)
+	require.Equal(t, "", port, "nothing is remembered without a state file")
+
+	require.NoError(t, saveRemotePort(path, "kyle@dev.kwc.io", "8443"))
+	require.NoError(t, saveRemotePort(path, "other.host", "9000"))
+	require.NoError(t, saveRemotePort(path, "kyle@dev.kwc.io", "8444"))
+
+	port, err = lastRemotePort(path, "kyle@dev.kwc.io")
+	require.NoError(t, err)
+	require.Equal(t, "8444", port)
+
+	port, err = lastRemotePort(path, "other.host")
+	require.NoError(t, err)
+	require.Equal(t, "9000", port)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0600))
+	_, err = lastRemotePort(path, "other.host")
+	require.Error(t, err)
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
+	"strings"
 
+	"go.coder.com/flog"
 	"golang.org/x/xerrors"
 )
 
@@ -13,38 +15,96 @@ const (
 	vsCodeExtensionsDirEnv = "VSCODE_EXTENSIONS_DIR"
 )
 
-func configDir() (string, error) {
+// defaultVSCodeFlavor is the VS Code flavor whose settings and extensions are
+// synced unless another one is selected.
+const defaultVSCodeFlavor = "stable"
+
+// vsCodeFlavor is the name of a VS Code flavor's config directory and of its
+// extensions directory in the home directory.
+type vsCodeFlavor struct {
+	configName     string
+	extensionsName string
+}
+
+// vsCodeFlavors are the VS Code flavors by the name --vscode-flavor takes.
+var vsCodeFlavors = map[string]vsCodeFlavor{
+	"stable":   {"Code", ".vscode"},
+	"insiders": {"Code - Insiders", ".vscode-insiders"},
+	"oss":      {"Code - OSS", ".vscode-oss"},
+}
+
+// lookupVSCodeFlavor returns the VS Code flavor called name, the default one if
+// name is empty.
+func lookupVSCodeFlavor(name string) (vsCodeFlavor, error) {
+	if name == "" {
+		name = defaultVSCodeFlavor
+	}
+	flavor, ok := vsCodeFlavors[name]
+	if !ok {
+		names := make([]string, 0, len(vsCodeFlavors))
+		for n := range vsCodeFlavors {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return vsCodeFlavor{}, xerrors.Errorf("unknown VS Code flavor %q, must be one of %v", name, strings.Join(names, ", "))
+	}
+	return flavor, nil
+}
+
+func configDir(goos, flavorName string) (string, error) {
 	if env, ok := os.LookupEnv(vsCodeConfigDirEnv); ok {
 		return os.ExpandEnv(env), nil
 	}
 
+	flavor, err := lookupVSCodeFlavor(flavorName)
+	if err != nil {
+		return "", err
+	}
+
 	var path string
-	switch runtime.GOOS {
+	switch goos {
 	case "linux":
-		path = os.ExpandEnv("$HOME/.config/Code/User/")
+		path = os.ExpandEnv("$HOME/.config/") + flavor.configName + "/User/"
 	case "darwin":
-		path = os.ExpandEnv("$HOME/Library/Application Support/Code/User/")
+		path = os.ExpandEnv("$HOME/Library/Application Support/") + flavor.configName + "/User/"
 	case "windows":
-		return os.ExpandEnv("/c/Users/$USERNAME/AppData/Roaming/Code/User"), nil
+		return os.ExpandEnv("/c/Users/$USERNAME/AppData/Roaming/") + flavor.configName + "/User", nil
 	default:
-		return "", xerrors.Errorf("unsupported platform: %s", runtime.GOOS)
+		return "", xerrors.Errorf("unsupported platform: %s", goos)
 	}
 	return filepath.Clean(path), nil
 }
 
-func extensionsDir() (string, error) {
+func extensionsDir(goos, flavorName string) (string, error) {
 	if env, ok := os.LookupEnv(vsCodeExtensionsDirEnv); ok {
 		return os.ExpandEnv(env), nil
 	}
 
+	flavor, err := lookupVSCodeFlavor(flavorName)
+	if err != nil {
+		return "", err
+	}
+
 	var path string
-	switch runtime.GOOS {
+	switch goos {
 	case "linux", "darwin":
-		path = os.ExpandEnv("$HOME/.vscode/extensions/")
+		path = os.ExpandEnv("$HOME/") + flavor.extensionsName + "/extensions/"
 	case "windows":
-		return os.ExpandEnv("/c/Users/$USERNAME/.vscode/extensions"), nil
+		return os.ExpandEnv("/c/Users/$USERNAME/") + flavor.extensionsName + "/extensions", nil
 	default:
-		return "", xerrors.Errorf("unsupported platform: %s", runtime.GOOS)
+		return "", xerrors.Errorf("unsupported platform: %s", goos)
 	}
 	return filepath.Clean(path), nil
 }
+
+// warnMissingVSCodeDir logs a warning if the local VS Code directory dir, which
+// holds what, doesn't exist. Most likely the wrong flavor of VS Code is synced
+// then, since VS Code creates its directories on its first start.
+func warnMissingVSCodeDir(dir, what string) {
+	_, err := os.Stat(nativePath(dir))
+	if os.IsNotExist(err) {
+		flog.Error("local %v directory %v doesn't exist, pick the installed VS Code with --vscode-flavor or set %v and %v",
+			what, dir, vsCodeConfigDirEnv, vsCodeExtensionsDirEnv,
+		)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVSCodeFlavorDirs(t *testing.T) {
+	for name, value := range map[string]string{"HOME": "/home/kyle", "USERNAME": "kyle"} {
+		old, ok := os.LookupEnv(name)
+		require.NoError(t, os.Setenv(name, value))
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	require.Empty(t, os.Getenv(vsCodeConfigDirEnv), "the overrides must not be set")
+	require.Empty(t, os.Getenv(vsCodeExtensionsDirEnv), "the overrides must not be set")
+
+	tests := []struct {
+		goos       string
+		flavor     string
+		config     string
+		extensions string
+	}{
+		{"linux", "", "/home/kyle/.config/Code/User", "/home/kyle/.vscode/extensions"},
+		{"linux", "stable", "/home/kyle/.config/Code/User", "/home/kyle/.vscode/extensions"},
+		{"linux", "insiders", "/home/kyle/.config/Code - Insiders/User", "/home/kyle/.vscode-insiders/extensions"},
+		{"linux", "oss", "/home/kyle/.config/Code - OSS/User", "/home/kyle/.vscode-oss/extensions"},
+		{"darwin", "stable", "/home/kyle/Library/Application Support/Code/User", "/home/kyle/.vscode/extensions"},
+		{"darwin", "insiders", "/home/kyle/Library/Application Support/Code - Insiders/User", "/home/kyle/.vscode-insiders/extensions"},
+		{"darwin", "oss", "/home/kyle/Library/Application Support/Code - OSS/User", "/home/kyle/.vscode-oss/extensions"},
+		{"windows", "stable", "/c/Users/kyle/AppData/Roaming/Code/User", "/c/Users/kyle/.vscode/extensions"},
+		{"windows", "insiders", "/c/Users/kyle/AppData/Roaming/Code - Insiders/User", "/c/Users/kyle/.vscode-insiders/extensions"},
+		{"windows", "oss", "/c/Users/kyle/AppData/Roaming/Code - OSS/User", "/c/Users/kyle/.vscode-oss/extensions"},
+	}
+	for _, tt := range tests {
+		config, err := configDir(tt.goos, tt.flavor)
+		require.NoError(t, err)
+		require.Equal(t, tt.config, config, tt.goos+" "+tt.flavor)
+
+		extensions, err := extensionsDir(tt.goos, tt.flavor)
+		require.NoError(t, err)
+		require.Equal(t, tt.extensions, extensions, tt.goos+" "+tt.flavor)
+	}
+
+	_, err := configDir("linux", "nightly")
+	require.Error(t, err)
+	_, err = extensionsDir("plan9", "stable")
+	require.Error(t, err)
+}
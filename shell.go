@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// shellCommand returns a command running cmdStr, a POSIX shell command line, in
+// a login shell so that e.g. an ssh-agent set up in the user's profile is used.
+//
+// Stock Windows has no sh, so there the command line is split into words and
+// its program run directly instead. That covers the commands sshcode builds,
+// which each run a single program such as ssh, but not pipelines, redirections
+// or variables.
+func shellCommand(cmdStr string) *exec.Cmd {
+	if commandExists("sh") {
+		return exec.Command("sh", "-l", "-c", cmdStr)
+	}
+
+	args, err := splitShellWords(cmdStr)
+	if err != nil || len(args) == 0 {
+		// Leave it to running the command to report the problem.
+		return exec.Command("sh", "-l", "-c", cmdStr)
+	}
+	return exec.Command(args[0], args[1:]...)
+}
+
+// splitShellWords splits s into words like a POSIX shell would, honoring single
+// and double quotes and backslash escapes. Nothing is expanded.
+func splitShellWords(s string) ([]string, error) {
+	var (
+		words []string
+		word  strings.Builder
+		// inWord is whether a word has started, which an empty quoted string
+		// like '' also does.
+		inWord bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, xerrors.Errorf("unterminated single quote in %q", s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// In double quotes, a backslash only escapes the characters
+				// that are special there.
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, xerrors.Errorf("unterminated double quote in %q", s)
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"ssh -G  host", []string{"ssh", "-G", "host"}},
+		{`ssh -o "ControlPath=/tmp/my dir/cm" host`, []string{"ssh", "-o", "ControlPath=/tmp/my dir/cm", "host"}},
+		{"ssh host " + shellEscape("test -x ~/it's here"), []string{"ssh", "host", "test -x ~/it's here"}},
+		{`echo "a \"b\" \$c \d" e\ f ''`, []string{"echo", `a "b" $c \d`, "e f", ""}},
+	}
+	for _, tt := range tests {
+		got, err := splitShellWords(tt.in)
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.want, got, tt.in)
+	}
+
+	_, err := splitShellWords("ssh 'host")
+	require.Error(t, err)
+	_, err = splitShellWords(`ssh "host`)
+	require.Error(t, err)
+}
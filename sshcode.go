@@ -1,74 +1,460 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/pkg/browser"
 	"go.coder.com/flog"
+	"go.coder.com/retry"
 	"golang.org/x/xerrors"
 )
 
-const codeServerPath = "~/.cache/sshcode/sshcode-server"
+const (
+	// defaultRemoteCacheDir is where code-server is installed on the remote
+	// host unless set with --remote-cache-dir.
+	defaultRemoteCacheDir = "~/.cache/sshcode"
+	// codeServerName is the name code-server is installed under.
+	codeServerName = "sshcode-server"
+)
+
+// remoteCacheDirRegexp matches the remote cache directories which can be used
+// unquoted in remote commands, leaving a leading ~ for the remote shell to
+// expand.
+var remoteCacheDirRegexp = regexp.MustCompile(`^[A-Za-z0-9_./~-]+$`)
+
+// codeServerPath returns where code-server is installed on the remote host.
+func codeServerPath(o options) string {
+	dir := o.remoteCacheDir
+	if dir == "" {
+		dir = defaultRemoteCacheDir
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + codeServerName
+}
+
+// codeServerLogPath returns where the output of a detached code-server goes.
+func codeServerLogPath(o options) string {
+	if o.sessionName != "" {
+		return codeServerPath(o) + "-" + o.sessionName + ".log"
+	}
+	return codeServerPath(o) + ".log"
+}
+
+// sessionNameRegexp matches the session names which can be used, which end
+// up in remote paths.
+var sessionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// remoteDataDir returns the directory code-server keeps its settings,
+// extensions and state in on the remote host, relative to the home directory
+// unless it's the absolute path given with --user-data-dir. Each named
+// session has one of its own.
+func remoteDataDir(o options) string {
+	if o.userDataDir != "" {
+		return o.userDataDir
+	}
+	if o.sessionName != "" {
+		return ".local/share/code-server-" + o.sessionName
+	}
+	return ".local/share/code-server"
+}
+
+// remoteDataPath returns the path of sub in remoteDataDir as rsync is given
+// it. Windows rsyncs would expand a leading ~ locally, there it's left out,
+// as paths relative to the home directory work as well.
+func remoteDataPath(sub string, o options) string {
+	p := remoteDataDir(o) + "/" + sub
+	if runtime.GOOS == "windows" || path.IsAbs(p) {
+		return p
+	}
+	return "~/" + p
+}
 
+// parseUserDataDir returns the remote directory given to --user-data-dir as
+// remoteDataDir returns it, relative to the home directory, which it may
+// start with ~/ for, or absolute. It ends up unquoted in remote commands.
+func parseUserDataDir(dir string) (string, error) {
+	clean := strings.TrimSuffix(strings.TrimPrefix(dir, "~/"), "/")
+	if clean == "" || clean == "." || strings.Contains(clean, "~") || !remoteCacheDirRegexp.MatchString(clean) {
+		return "", xerrors.Errorf("invalid user data directory %q, must be a path relative to the home directory or absolute, "+
+			"with only letters, digits and _ . / - in it", dir)
+	}
+	return clean, nil
+}
+
+// defaultStartupTimeout is how long code-server has to become reachable unless
+// set with --startup-timeout.
+const defaultStartupTimeout = 15 * time.Second
+
+// shutdownGracePeriod is how long code-server has to exit after being asked to
+// on interrupt, before it's killed and the session torn down regardless.
+const shutdownGracePeriod = 5 * time.Second
+
+// osAssignedPort is the remote port which makes code-server listen on a port
+// picked by the remote OS.
+const osAssignedPort = "0"
+
+// sshControlPersist is how long a master connection started by another
+// connection outlives it, if the initial master connection goes away.
+const sshControlPersist = "60s"
+
+// Directions for the settings and extensions sync done on startup.
 const (
-	sshDirectory               = "~/.ssh"
-	sshDirectoryUnsafeModeMask = 0022
-	sshControlPath             = sshDirectory + "/control-%h-%p-%r"
+	// syncPush copies local settings and extensions to the remote host.
+	syncPush = "push"
+	// syncPull copies remote settings and extensions to the local host.
+	syncPull = "pull"
+	// syncBoth pushes on startup and pulls back on termination.
+	syncBoth = "both"
 )
 
 type options struct {
-	skipSync         bool
-	syncBack         bool
-	noOpen           bool
-	reuseConnection  bool
-	bindAddr         string
-	remotePort       string
-	sshFlags         string
-	uploadCodeServer string
+	skipSync          bool
+	syncBack          bool
+	noOpen            bool
+	reuseConnection   bool
+	keepSession       bool
+	notify            bool
+	tls               bool
+	noDefaultExcludes bool
+	syncPreview       bool
+	pruneOldVersions  bool
+	bindAddr          string
+	remotePort        string
+	sshFlags          string
+	uploadCodeServer  string
+	syncDirection     string
+	chromeProfileDir  string
+	openBrowserCmd    string
+	windowName        string
+	jumpHost          string
+	jumpIdentity      string
+	remoteIonice      string
+	envPassthrough    []string
+	warm              bool
+	resumeSync        bool
+	downloadURL       string
+	localBindOnly     bool
+	remoteAccessible  bool
+	syncTasks         bool
+	probeInterval     time.Duration
+	encryptSettings   bool
+	gpgRecipient      string
+	attach            bool
+	hostKeyChecking   string
+	dryRun            bool
+	logLevel          logLevel
+	codeServerVersion string
+	skipChecksum      bool
+	browser           string
+	startupTimeout    time.Duration
+	syncExcludes      []string
+	noDownload        bool
+	bindAll           bool
+	auth              bool
+	kill              bool
+	codeServerFlags   string
+	connectRetries    int
+	remoteCacheDir    string
+	onReady           string
+	noIncognito       bool
+	allowExtensions   bool
+	syncBackOnly      bool
+	noDelete          bool
+	vsCodeFlavor      string
+	syncTimeout       time.Duration
+	sshBinary         string
+	extensions        []string
+	agentForward      bool
+	noKillExisting    bool
+	rsyncFlags        string
+	localPort         string
+	sessionName       string
+	skipSettings      bool
+	skipExtensions    bool
+	openFile          string
+	printURLOnly      bool
+	stopFile          string
+	insecureHostKey   bool
+	knownHosts        string
+	reconnect         int
+	forwards          []string
+	user              string
+	gcpCacheTTL       time.Duration
+	gcpRefresh        bool
+	userDataDir       string
+	remoteNice        int
+	// password is the one code-server requires with auth or remoteAccessible.
+	password string
+	// maxSyncSize is the maximum size in bytes of a local directory to sync,
+	// zero means no limit.
+	maxSyncSize int64
+	// statusOut is where the session status is written as JSON once
+	// code-server is ready, nil for nowhere.
+	statusOut io.Writer
+	// urlOut is where the URL is written on its own line once code-server
+	// is ready with printURLOnly, nil for nowhere.
+	urlOut io.Writer
 }
 
 func sshCode(host, dir string, o options) error {
-	host, extraSSHFlags, err := parseHost(host)
+	host, extraSSHFlags, err := parseHost(withUser(host, o.user), o)
+	if err != nil {
+		return withKind(ErrResolveHost, xerrors.Errorf("failed to parse host IP: %w", err))
+	}
+	if o.insecureHostKey {
+		switch o.hostKeyChecking {
+		case "":
+			o.hostKeyChecking = "accept-new"
+		case "yes":
+			return xerrors.New("--insecure-host-key can't be used with --host-key-checking yes")
+		}
+	}
+	o.sshFlags, err = buildSSHFlags(extraSSHFlags, o)
 	if err != nil {
-		return xerrors.Errorf("failed to parse host IP: %w", err)
+		return err
 	}
-	if extraSSHFlags != "" {
-		o.sshFlags = strings.Join([]string{extraSSHFlags, o.sshFlags}, " ")
+	if o.hostKeyChecking == "accept-new" || o.hostKeyChecking == "no" {
+		flog.Error("the host key of a new host is trusted without checking, " +
+			"so the first connection could be to an impostor")
+	}
+	if o.agentForward && os.Getenv("SSH_AUTH_SOCK") == "" {
+		flog.Error("--agent-forward was given, but SSH_AUTH_SOCK isn't set, so there's no ssh-agent to forward")
 	}
 
-	o.bindAddr, err = parseBindAddr(o.bindAddr)
-	if err != nil {
-		return xerrors.Errorf("failed to parse bind address: %w", err)
+	if o.codeServerVersion != "" && !codeServerVersionRegexp.MatchString(o.codeServerVersion) {
+		return xerrors.Errorf("invalid code-server version %q", o.codeServerVersion)
+	}
+	if o.codeServerVersion != "" {
+		// Recorded on the remote host, so it must be spelled the same each time.
+		o.codeServerVersion = "v" + strings.TrimPrefix(o.codeServerVersion, "v")
 	}
 
-	if o.remotePort == "" {
-		o.remotePort, err = randomPort()
+	// ssh resolves aliases from the ssh config by itself, so the actual
+	// hostname is only looked up when it's needed to reach code-server
+	// directly, saving a run of ssh otherwise.
+	hostConfig := sshHostConfig{hostname: sshHostname(host)}
+	if o.remoteAccessible {
+		resolved, err := resolveSSHHost(host, o.sshFlags)
+		// ssh before OpenSSH 6.8 has no -G.
+		if err == nil {
+			hostConfig = resolved
+		}
+		if hostConfig.hostname != sshHostname(host) {
+			logInfo(o, "%v resolves to %v@%v port %v", host, hostConfig.user, hostConfig.hostname, hostConfig.port)
+		}
 	}
+
+	syncBack, err := syncsBack(o.syncDirection)
 	if err != nil {
-		return xerrors.Errorf("failed to find available remote port: %w", err)
+		return err
+	}
+	o.syncBack = o.syncBack || syncBack
+
+	if o.startupTimeout == 0 {
+		o.startupTimeout = defaultStartupTimeout
+	}
+	if o.startupTimeout < 0 {
+		return xerrors.Errorf("invalid startup timeout %v, must be positive", o.startupTimeout)
+	}
+
+	if o.remoteNice < -20 || o.remoteNice > 19 {
+		return xerrors.Errorf("invalid remote niceness %v, must be between -20 and 19", o.remoteNice)
+	}
+
+	for _, name := range o.envPassthrough {
+		if !envNameRegexp.MatchString(name) {
+			return xerrors.Errorf("invalid environment variable name %q", name)
+		}
+		if _, ok := os.LookupEnv(name); !ok {
+			flog.Info("%v isn't set locally, not passing it through", name)
+		}
+	}
+
+	if o.remoteCacheDir != "" && !remoteCacheDirRegexp.MatchString(o.remoteCacheDir) {
+		return xerrors.Errorf("invalid remote cache directory %q, only letters, digits and _ . / ~ - are allowed", o.remoteCacheDir)
+	}
+
+	for _, id := range o.extensions {
+		if !extensionIDRegexp.MatchString(id) {
+			return xerrors.Errorf("invalid extension ID %q, must be of the form publisher.name", id)
+		}
+	}
+
+	if o.stopFile != "" && pathExists(o.stopFile) {
+		return xerrors.Errorf("stop file %v already exists, which would end the session right away", o.stopFile)
+	}
+
+	if o.openFile != "" {
+		err = validateOpenFile(o.openFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.userDataDir != "" {
+		if o.sessionName != "" {
+			return xerrors.New("--user-data-dir and --session-name both set where code-server keeps its data, only give one")
+		}
+		o.userDataDir, err = parseUserDataDir(o.userDataDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.sessionName != "" && !sessionNameRegexp.MatchString(o.sessionName) {
+		return xerrors.Errorf("invalid session name %q, only letters, digits and _ . - are allowed", o.sessionName)
 	}
 
-	// Check the SSH directory's permissions and warn the user if it is not safe.
-	o.reuseConnection = checkSSHDirectory(sshDirectory, o.reuseConnection)
+	if _, err := splitShellWords(o.rsyncFlags); err != nil {
+		return xerrors.Errorf("invalid rsync flags: %w", err)
+	}
+
+	if _, err := lookupVSCodeFlavor(o.vsCodeFlavor); err != nil {
+		return err
+	}
+
+	if o.connectRetries < 0 {
+		return xerrors.Errorf("invalid number of connect retries %v, must not be negative", o.connectRetries)
+	}
+
+	if o.remoteIonice != "" {
+		o.remoteIonice, err = parseIoniceClass(o.remoteIonice)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.encryptSettings {
+		if o.gpgRecipient == "" {
+			return xerrors.New("--encrypt-settings needs a key to encrypt for, set with --gpg-recipient")
+		}
+		if !commandExists("gpg") {
+			return xerrors.New("--encrypt-settings needs gpg to be installed")
+		}
+	}
+
+	// --skipsync is short for skipping both, and skipping both is skipping
+	// the sync.
+	if o.skipSync {
+		o.skipSettings, o.skipExtensions = true, true
+	}
+	if o.skipSettings && o.skipExtensions {
+		o.skipSync = true
+	}
+	if o.skipExtensions && len(o.extensions) > 0 {
+		return xerrors.New("--extensions selects extensions to sync, which --skip-extensions skips")
+	}
+
+	// Syncing shells out to rsync, so check for it before connecting rather
+	// than failing halfway with an exec error.
+	if !o.skipSync && !o.kill && !commandExists("rsync") {
+		return xerrors.Errorf("rsync is needed to sync settings and extensions but wasn't found in $PATH, "+
+			"%v, or pass --skipsync to skip syncing", rsyncInstallHint(runtime.GOOS))
+	}
+
+	if _, ok := browserPaths[o.browser]; !ok && o.browser != "" && o.browser != defaultBrowser {
+		return xerrors.Errorf("invalid browser %q, must be one of chrome, firefox, edge or %v", o.browser, defaultBrowser)
+	}
+
+	if o.localBindOnly && o.remoteAccessible {
+		return xerrors.New("--local-bind-only and --remote-accessible can't be used together")
+	}
+	if o.remoteAccessible {
+		if o.bindAddr != "" || o.bindAll || o.localPort != "" {
+			return xerrors.New("--bind, --bind-all and --local-port set the local end of the tunnel, which isn't used with --remote-accessible")
+		}
+		// Reachable by anyone who can reach the host, so always require the
+		// password.
+		o.auth = true
+	} else {
+		if o.bindAll {
+			if o.bindAddr != "" && !strings.HasPrefix(o.bindAddr, ":") {
+				return xerrors.New("--bind-all can only be combined with a port, e.g. --bind :8080")
+			}
+			o.bindAddr = "0.0.0.0" + o.bindAddr
+		}
+		o.bindAddr, err = parseBindAddr(o.bindAddr, o.localPort)
+		if err != nil {
+			return xerrors.Errorf("failed to parse bind address: %w", err)
+		}
+		if !isLoopbackAddr(o.bindAddr) && !o.auth {
+			flog.Error("WARNING: code-server runs without authentication and is exposed to anyone who can reach %v, consider --auth", o.bindAddr)
+		}
+		// Windows has no privileged ports.
+		if _, port, _ := net.SplitHostPort(o.bindAddr); isPrivilegedPort(port) && runtime.GOOS != "windows" && os.Geteuid() != 0 {
+			flog.Error("local port %v is below %v, which usually only root may listen on, "+
+				"so the tunnel is likely to fail with \"permission denied\", pick a port of %v or above", port, minPort, minPort)
+		}
+	}
+	// The remote port may only be picked later, when it's checked again.
+	if _, err := extraForwardSpecs(o.forwards, o.bindAddr, o.remotePort); err != nil {
+		return err
+	}
+	if o.auth {
+		o.password, err = codeServerPassword()
+		if err != nil {
+			return xerrors.Errorf("failed to generate password: %w", err)
+		}
+	}
+
+	if o.syncBackOnly && o.skipSync {
+		return xerrors.New("--sync-back-only and --skipsync can't be used together")
+	}
+
+	if o.noDownload && o.uploadCodeServer != "" {
+		return xerrors.New("--no-download and --upload-code-server can't be used together")
+	}
+
+	if o.attach && (o.remotePort == "" || o.remotePort == osAssignedPort) {
+		return xerrors.New("--attach needs the --remote-port of the code-server to attach to")
+	}
+	if o.attach && o.auth {
+		return xerrors.New("--attach can't be used with --auth or --remote-accessible, the running code-server's password is unknown")
+	}
+
+	if o.remotePort == osAssignedPort && o.keepSession {
+		return xerrors.New("a kept session needs a known remote port to reconnect to, " +
+			"--remote-port 0 can't be used with --keep-session")
+	}
+
+	// The OpenSSH client shipped with Windows doesn't support master connections.
+	if runtime.GOOS == "windows" && o.reuseConnection {
+		flog.Info("OS is windows, disabling connection reuse feature")
+		o.reuseConnection = false
+	}
 
 	// Start SSH master connection socket. This prevents multiple password prompts from appearing as authentication
 	// only happens on the initial connection.
-	if o.reuseConnection {
-		flog.Info("starting SSH master connection...")
-		newSSHFlags, cancel, err := startSSHMaster(o.sshFlags, sshControlPath, host)
+	if o.reuseConnection && !o.dryRun {
+		logInfo(o, "starting SSH master connection...")
+		newSSHFlags, cancel, err := startSSHMaster(o.sshFlags, host)
 		defer cancel()
 		if err != nil {
 			flog.Error("failed to start SSH master connection: %v", err)
@@ -78,148 +464,776 @@ func sshCode(host, dir string, o options) error {
 		}
 	}
 
-	// Upload local code-server or download code-server from CI server.
-	if o.uploadCodeServer != "" {
-		flog.Info("uploading local code-server binary...")
-		err = copyCodeServerBinary(o.sshFlags, host, o.uploadCodeServer, codeServerPath)
+	if o.kill {
+		port := o.remotePort
+		if port == osAssignedPort {
+			port = ""
+		}
+		stopped, err := stopCodeServer(host, port, shutdownGracePeriod, o)
+		if err != nil {
+			return withKind(ErrConnect, xerrors.Errorf("failed to stop code-server: %w", err))
+		}
+		switch {
+		case o.dryRun:
+		case stopped:
+			flog.Info("stopped code-server on %v", host)
+		default:
+			flog.Info("no code-server running on %v", host)
+		}
+		return nil
+	}
+
+	if o.syncBackOnly {
+		logInfo(o, "synchronizing VS Code back to local")
+		return syncBackToLocal(host, o)
+	}
+
+	if o.syncPreview {
+		if o.skipSync {
+			return xerrors.New("there is no sync to preview when syncing is skipped")
+		}
+
+		flog.Info("previewing sync, nothing will be changed")
+		pull := o.syncDirection == syncPull
+
+		if !o.skipSettings {
+			flog.Info("settings:")
+			err = syncUserSettings(host, pull, o)
+			if err != nil {
+				return withKind(ErrSyncSettings, xerrors.Errorf("failed to preview settings sync: %w", err))
+			}
+		}
+
+		if !o.skipExtensions {
+			flog.Info("extensions:")
+			err = syncExtensions(host, pull, o)
+			if err != nil {
+				return withKind(ErrSyncExtensions, xerrors.Errorf("failed to preview extensions sync: %w", err))
+			}
+		}
+		return nil
+	}
+
+	// rememberPort is whether the remote port is up to sshcode, in which case
+	// the last one used for host is preferred, to keep the same URL.
+	rememberPort := o.remotePort == ""
+	portStatePath, err := portStateFile()
+	if err != nil {
+		flog.Error("failed to find where to remember the remote port: %v", err)
+		rememberPort = false
+	}
+	if o.remotePort == "" {
+		var lastPort string
+		if rememberPort {
+			lastPort, err = lastRemotePort(portStatePath, host)
+			if err != nil {
+				flog.Error("failed to read last remote port: %v", err)
+			}
+		}
+		// A code-server kept running by the last session is picked up again,
+		// rather than starting another one on a free port.
+		if o.keepSession && lastPort != "" && !o.dryRun {
+			lastOpts := o
+			lastOpts.remotePort = lastPort
+			running, err := codeServerRunning(host, lastOpts)
+			if err != nil {
+				flog.Error("failed to check for kept code-server: %v", err)
+			} else if running {
+				logInfo(o, "reconnecting to code-server kept running on remote port %v", lastPort)
+				o.remotePort = lastPort
+			}
+		}
+		if o.remotePort == "" {
+			o.remotePort, err = freeRemotePort(host, lastPort, o)
+			if err != nil {
+				return withKind(ErrStart, xerrors.Errorf("failed to find available remote port: %w", err))
+			}
+		}
+	}
+
+	// attached is whether code-server is already running, so that the tunnel
+	// can just be attached to it.
+	attached := false
+	if o.attach && !o.dryRun {
+		attached, err = codeServerRunning(host, o)
+		if err != nil {
+			return withKind(ErrConnect, xerrors.Errorf("failed to check for running code-server: %w", err))
+		}
+		if !attached {
+			flog.Info("no code-server running on remote port %v, starting one", o.remotePort)
+		}
+	}
+
+	if o.warm && !o.dryRun {
+		o.warm, err = codeServerInstalled(host, o)
+		if err != nil {
+			return withKind(ErrConnect, xerrors.Errorf("failed to check for cached code-server: %w", err))
+		}
+		if !o.warm {
+			flog.Info("no cached code-server found, doing a full start")
+		}
+	}
+
+	if o.noDownload && !attached && !o.warm && !o.dryRun {
+		installed, err := codeServerInstalled(host, o)
 		if err != nil {
-			return xerrors.Errorf("failed to upload local code-server binary to remote server: %w", err)
+			return withKind(ErrConnect, xerrors.Errorf("failed to check for installed code-server: %w", err))
+		}
+		if !installed {
+			return permanent(xerrors.Errorf("--no-download was given but there is no code-server at %v on the remote host", codeServerPath(o)))
 		}
+	}
 
-		sshCmdStr :=
-			fmt.Sprintf("ssh %v %v 'chmod +x %v'",
-				o.sshFlags, host, codeServerPath,
+	// Upload local code-server or download code-server from CI server.
+	if attached {
+		flog.Info("attaching to code-server running on remote port %v", o.remotePort)
+	} else if o.warm {
+		flog.Info("warm start, skipping download and sync")
+	} else if o.noDownload {
+		logInfo(o, "using code-server already on the remote host")
+	} else if o.uploadCodeServer != "" {
+		logInfo(o, "uploading local code-server binary...")
+		err = copyCodeServerBinary(host, o.uploadCodeServer, codeServerPath(o), o)
+		if err != nil {
+			return withKind(ErrDownload,
+				xerrors.Errorf("failed to upload local code-server binary to remote server: %w", err),
 			)
+		}
 
-		sshCmd := exec.Command("sh", "-l", "-c", sshCmdStr)
+		sshCmdStr := remoteCommand(o.sshFlags, host, "chmod +x "+codeServerPath(o))
+
+		sshCmd := shellCommand(sshCmdStr)
 		sshCmd.Stdout = os.Stdout
 		sshCmd.Stderr = os.Stderr
-		err = sshCmd.Run()
+		err = run(sshCmd, o)
 		if err != nil {
-			return xerrors.Errorf("failed to make code-server binary executable:\n---ssh cmd---\n%s: %w",
-				sshCmdStr,
-				err,
+			return withKind(ErrDownload,
+				xerrors.Errorf("failed to make code-server binary executable:\n---ssh cmd---\n%s: %w",
+					sshCmdStr,
+					err,
+				),
 			)
 		}
 	} else {
-		flog.Info("ensuring code-server is updated...")
-		dlScript := downloadScript(codeServerPath)
+		logInfo(o, "ensuring code-server is updated...")
+		// A stale code-server on the port would keep the new one from
+		// listening. A kept session may still be running from a previous run
+		// though, it must survive the update so that we can reattach to it.
+		killPort := o.remotePort
+		if o.keepSession || o.noKillExisting || killPort == osAssignedPort {
+			killPort = ""
+		}
+		dlScript := downloadScript(codeServerPath(o), remoteDataDir(o), killPort,
+			downloadURLs(o.downloadURL, o.codeServerVersion), o.codeServerVersion, !o.skipChecksum,
+		)
 
 		// Downloads the latest code-server and allows it to be executed.
-		sshCmdStr := fmt.Sprintf("ssh %v %v '/usr/bin/env bash -l'", o.sshFlags, host)
-		sshCmd := exec.Command("sh", "-l", "-c", sshCmdStr)
-		sshCmd.Stdout = os.Stdout
-		sshCmd.Stderr = os.Stderr
-		sshCmd.Stdin = strings.NewReader(dlScript)
-		err = sshCmd.Run()
+		sshCmdStr := remoteCommand(o.sshFlags, host, "/usr/bin/env bash -l")
+		if o.dryRun {
+			flog.Info("dry run: download script:\n%s", dlScript)
+		}
+		// This is usually the first connection, so it's retried right away
+		// when it drops, rather than starting all over.
+		backoff := &retry.Backoff{
+			Floor: time.Second,
+			Ceil:  10 * time.Second,
+		}
+		var stderr string
+		for attempt := 1; ; attempt++ {
+			stderr, err = runDownloadScript(sshCmdStr, dlScript, o)
+			if err == nil || attempt > o.connectRetries || !isSSHConnectError(err) || isPermanentSSHOutput(stderr) {
+				break
+			}
+			flog.Error("failed to connect: %v", err)
+			flog.Info("retrying download (%v/%v)...", attempt, o.connectRetries)
+			_ = backoff.Wait(context.Background())
+		}
 		if err != nil {
-			return xerrors.Errorf("failed to update code-server:\n---ssh cmd---\n%s"+
-				"\n---download script---\n%s: %w",
-				sshCmdStr,
-				dlScript,
-				err,
+			kind := ErrDownload
+			if isSSHConnectError(err) {
+				kind = ErrConnect
+			}
+			var exitErr *exec.ExitError
+			if xerrors.As(err, &exitErr) {
+				switch exitErr.ExitCode() {
+				case checksumFailedExitCode:
+					return withKind(ErrChecksum, xerrors.Errorf(
+						"downloaded code-server failed checksum verification, it was not installed: %w", err,
+					))
+				case checksumMissingExitCode:
+					return withKind(ErrDownload, xerrors.Errorf(
+						"failed to download the checksum of code-server, pass --skip-checksum if the mirror doesn't publish checksums: %w", err,
+					))
+				}
+			}
+			err = withKind(kind,
+				xerrors.Errorf("failed to update code-server:\n---ssh cmd---\n%s"+
+					"\n---download script---\n%s: %w",
+					sshCmdStr,
+					dlScript,
+					err,
+				),
 			)
+			if kind == ErrConnect && isPermanentSSHOutput(stderr) {
+				err = permanent(err)
+			}
+			return err
 		}
 	}
 
-	if !o.skipSync {
+	if !o.skipSync && !o.warm {
+		// Pulling makes the remote host's settings the authoritative ones.
+		pull := o.syncDirection == syncPull
+
 		start := time.Now()
-		flog.Info("syncing settings")
-		err = syncUserSettings(o.sshFlags, host, false)
-		if err != nil {
-			return xerrors.Errorf("failed to sync settings: %w", err)
+		if !o.skipSettings {
+			logInfo(o, "syncing settings")
+			err = syncUserSettings(host, pull, o)
+			if err != nil {
+				return withKind(ErrSyncSettings, xerrors.Errorf("failed to sync settings: %w", err))
+			}
+
+			logInfo(o, "synced settings in %s", time.Since(start))
 		}
 
-		flog.Info("synced settings in %s", time.Since(start))
+		if !o.skipExtensions {
+			logInfo(o, "syncing extensions")
+			err = syncExtensions(host, pull, o)
+			if err != nil {
+				return withKind(ErrSyncExtensions, xerrors.Errorf("failed to sync extensions: %w", err))
+			}
+			logInfo(o, "synced extensions in %s", time.Since(start))
+		}
+	}
 
-		flog.Info("syncing extensions")
-		err = syncExtensions(o.sshFlags, host, false)
+	// Registered before code-server is started, so that an interrupt arriving
+	// while it starts up still ends the session.
+	interrupt, stopInterrupt := notifyInterrupt()
+	defer stopInterrupt()
+	// SIGHUP pushes local settings and extensions again without restarting.
+	// It's registered here too, as it would otherwise end sshcode while
+	// code-server starts up. One arriving then is handled once it's ready.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// launchCmd runs code-server when it isn't started by the tunnel itself.
+	var launchCmd *exec.Cmd
+
+	remoteCmdStr := codeServerCommand(dir, o)
+	// launchPort is the port code-server is started with, which identifies it
+	// on the remote host even once an OS assigned port is known.
+	launchPort := o.remotePort
+	// detached is whether code-server is started apart from the tunnel just so
+	// that it survives reconnecting.
+	detached := o.reconnect > 0 && !attached && !o.keepSession && o.remotePort != osAssignedPort
+	if !attached {
+		logInfo(o, "starting code-server...")
+	}
+	switch {
+	case attached:
+		// The running code-server belongs to whoever started it, the tunnel
+		// must leave it be when closing.
+		remoteCmdStr = "cat > /dev/null"
+	case o.keepSession || detached:
+		err = startDetachedCodeServer(host, remoteCmdStr, o)
+		if err != nil {
+			return withKind(ErrStart, xerrors.Errorf("failed to start detached code-server: %w", err))
+		}
+		// code-server no longer depends on the tunnel, so following its log
+		// is all that keeps the tunnel open.
+		remoteCmdStr = "tail -f " + codeServerLogPath(o)
+	case o.remotePort == osAssignedPort && o.dryRun:
+		flog.Info("dry run: code-server would be started before the tunnel, to learn its port")
+	case o.remotePort == osAssignedPort:
+		// The port to forward is only known once code-server is listening.
+		launchCmd, o.remotePort, err = startCodeServerOnAssignedPort(o.sshFlags, host, remoteCmdStr, o.startupTimeout)
 		if err != nil {
-			return xerrors.Errorf("failed to sync extensions: %w", err)
+			return withKind(ErrStart, xerrors.Errorf("failed to start code-server: %w", err))
 		}
-		flog.Info("synced extensions in %s", time.Since(start))
+		remoteCmdStr = "cat > /dev/null"
 	}
 
-	flog.Info("starting code-server...")
-
-	flog.Info("Tunneling remote port %v to %v", o.remotePort, o.bindAddr)
-
-	sshCmdStr :=
-		fmt.Sprintf("ssh -tt -q -L %v:localhost:%v %v %v '%v  %v --host 127.0.0.1 --auth none --port=%v'",
-			o.bindAddr, o.remotePort, o.sshFlags, host, codeServerPath, dir, o.remotePort,
-		)
-	// Starts code-server and forwards the remote port.
-	sshCmd := exec.Command("sh", "-l", "-c", sshCmdStr)
-	sshCmd.Stdin = os.Stdin
-	sshCmd.Stdout = os.Stdout
-	sshCmd.Stderr = os.Stderr
-	err = sshCmd.Start()
+	// addr is where code-server can be reached from here.
+	addr := o.bindAddr
+	forwardFlags := "-L " + shellEscape(forwardSpec(o.bindAddr, o.remotePort))
+	if o.remoteAccessible {
+		addr = net.JoinHostPort(hostConfig.hostname, o.remotePort)
+		forwardFlags = ""
+		flog.Info("code-server is listening on all interfaces of the remote host, log in with password %v", o.password)
+	} else {
+		logInfo(o, "Tunneling remote port %v to local address %v", o.remotePort, o.bindAddr)
+		if o.auth {
+			flog.Info("log in to code-server with password %v", o.password)
+		}
+	}
+	extraSpecs, err := extraForwardSpecs(o.forwards, o.bindAddr, o.remotePort)
 	if err != nil {
-		return xerrors.Errorf("failed to start code-server: %w", err)
+		return err
+	}
+	for _, spec := range extraSpecs {
+		logInfo(o, "forwarding %v", spec)
+		forwardFlags = strings.TrimSpace(forwardFlags + " -L " + shellEscape(spec))
 	}
 
-	url := fmt.Sprintf("http://%s", o.bindAddr)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
+	sshCmdStr := tunnelCommand(o.sshBinary, forwardFlags, o.sshFlags, host, remoteCmdStr)
+	if o.dryRun {
+		flog.Info("dry run: %v", redactEnv(sshCmdStr, o))
+		return nil
+	}
 
-	client := http.Client{
-		Timeout: time.Second * 3,
+	scheme := "http"
+	if o.tls {
+		scheme = "https"
 	}
-	for {
-		if ctx.Err() != nil {
-			return xerrors.Errorf("code-server didn't start in time: %w", ctx.Err())
+	url := fmt.Sprintf("%v://%s", scheme, addr)
+
+	// Through the tunnel, ssh has already authenticated the host, so
+	// code-server's self-signed certificate doesn't need to be verified.
+	// Reaching it directly with --remote-accessible, it does.
+	client := readinessClient(probeTimeout(o.startupTimeout), o.tls && !o.remoteAccessible)
+	var (
+		sshCmd *exec.Cmd
+		// tunnelEnded receives the result of waiting for sshCmd.
+		tunnelEnded <-chan error
+	)
+	// connect starts the tunnel, which also starts code-server unless it's
+	// already running, and waits for code-server to be reachable through it.
+	// Being interrupted meanwhile is reported as stopped.
+	connect := func() (stopped bool, err error) {
+		sshCmd = shellCommand(sshCmdStr)
+		// Reading the terminal would stop sshcode when run in the background.
+		if !o.printURLOnly {
+			sshCmd.Stdin = os.Stdin
 		}
-		// Waits for code-server to be available before opening the browser.
-		resp, err := client.Get(url)
+		sshCmd.Stdout = os.Stdout
+		sshCmd.Stderr = os.Stderr
+		logCommand(o, sshCmd)
+		err = sshCmd.Start()
 		if err != nil {
-			continue
+			return false, withKind(ErrStart, xerrors.Errorf("failed to start code-server: %w", err))
 		}
-		resp.Body.Close()
-		break
-	}
-
-	ctx, cancel = context.WithCancel(context.Background())
-
-	if !o.noOpen {
-		openBrowser(url)
-	}
 
-	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), o.startupTimeout)
 		defer cancel()
-		sshCmd.Wait()
-	}()
-
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
+		ended := make(chan error, 1)
+		go func() {
+			err := sshCmd.Wait()
+			ended <- err
+			// There's no point in waiting for code-server once the tunnel
+			// failed, but one ended by Ctrl-C is handled as an interrupt.
+			if sessionError(err) != nil {
+				cancel()
+			}
+		}()
+		tunnelEnded = ended
 
-	select {
-	case <-ctx.Done():
-	case <-c:
+		// Waits for code-server to be available before opening the browser.
+		stopped, err = waitForCodeServer(ctx, client, url, o.probeInterval, interrupt)
+		if err != nil {
+			select {
+			case tunnelErr := <-ended:
+				err = xerrors.Errorf("tunnel exited before code-server was ready: %w", tunnelErr)
+				if isSSHConnectError(tunnelErr) {
+					err = withKind(ErrConnect, err)
+				}
+			default:
+				_ = sshCmd.Process.Kill()
+			}
+		}
+		return stopped, err
 	}
 
-	flog.Info("shutting down")
-	if !o.syncBack || o.skipSync {
+	stopped, err := connect()
+	if err != nil {
+		return err
+	}
+	if stopped {
+		flog.Info("interrupted while waiting for code-server to start")
+		// code-server started by the tunnel goes with it.
+		_ = sshCmd.Process.Kill()
+		if launchCmd != nil {
+			_ = launchCmd.Process.Kill()
+		}
+		if detached {
+			_, err = stopCodeServer(host, launchPort, shutdownGracePeriod, o)
+			if err != nil {
+				flog.Error("failed to stop code-server: %v", err)
+			}
+		}
 		return nil
 	}
 
-	flog.Info("synchronizing VS Code back to local")
-
-	err = syncExtensions(o.sshFlags, host, true)
-	if err != nil {
-		return xerrors.Errorf("failed to sync extensions back: %w", err)
+	if rememberPort {
+		err = saveRemotePort(portStatePath, host, o.remotePort)
+		if err != nil {
+			flog.Error("failed to remember remote port: %v", err)
+		}
 	}
 
-	err = syncUserSettings(o.sshFlags, host, true)
-	if err != nil {
-		return xerrors.Errorf("failed to sync user settings back: %w", err)
+	if o.pruneOldVersions {
+		err = pruneCodeServerBinaries(host, o)
+		if err != nil {
+			flog.Error("failed to prune old code-server binaries: %v", err)
+		}
 	}
 
-	return nil
-}
+	if o.statusOut != nil {
+		status := sessionStatus{
+			URL:        url,
+			Host:       host,
+			RemotePort: o.remotePort,
+			Password:   o.password,
+			PID:        os.Getpid(),
+		}
+		if !o.remoteAccessible {
+			status.BindAddr = o.bindAddr
+			_, status.LocalPort, _ = net.SplitHostPort(o.bindAddr)
+		}
+		err = writeSessionStatus(o.statusOut, status)
+		if err != nil {
+			flog.Error("failed to write session status: %v", err)
+		}
+	}
 
-// expandPath returns an expanded version of path.
-func expandPath(path string) string {
-	path = filepath.Clean(os.ExpandEnv(path))
+	if o.notify {
+		notify("sshcode", fmt.Sprintf("code-server on %v is ready at %v", host, url))
+	}
+
+	if o.onReady != "" {
+		hookCmd, err := startOnReadyHook(o.onReady, url, host)
+		if err != nil {
+			flog.Error("failed to run --on-ready command: %v", err)
+		} else {
+			go func() {
+				err := hookCmd.Wait()
+				if err != nil {
+					flog.Error("--on-ready command failed: %v", err)
+				}
+			}()
+		}
+	}
+
+	// browserURL is url, or where it opens --open-file.
+	browserURL := url
+	if o.openFile != "" {
+		out, err := runRemote(host, "cd "+parseRemoteDir(dir)+" && pwd", o)
+		if err != nil {
+			flog.Error("failed to find %v on the remote host, not opening %v: %v", dir, o.openFile, err)
+		} else {
+			browserURL, err = openFileURL(url, strings.TrimSpace(out), o.openFile)
+			if err != nil {
+				flog.Error("failed to open %v: %v", o.openFile, err)
+				browserURL = url
+			}
+		}
+	}
+
+	switch {
+	case o.printURLOnly:
+		if o.urlOut != nil {
+			_, err = fmt.Fprintln(o.urlOut, browserURL)
+			if err != nil {
+				flog.Error("failed to write URL: %v", err)
+			}
+		}
+	case o.noOpen:
+		// Otherwise the URL is easily lost among the log lines before.
+		fmt.Print(readyMessage(browserURL, o.password))
+	default:
+		openBrowser(browserURL, o)
+	}
+
+	// stop is closed once the stop file exists, and never without one.
+	var stop <-chan struct{}
+	if o.stopFile != "" {
+		done := make(chan struct{})
+		defer close(done)
+		stop = watchStopFile(o.stopFile, stopFileInterval, done)
+	}
+
+	// launchEnded receives the result of waiting for launchCmd, and never
+	// without one.
+	var launchEnded <-chan error
+	if launchCmd != nil {
+		ended := make(chan error, 1)
+		go func() {
+			ended <- launchCmd.Wait()
+		}()
+		launchEnded = ended
+	}
+
+	interrupted := false
+	// sessionErr is why the session ended, if it wasn't the user ending it.
+	var sessionErr error
+	// endedErr is the result of waiting for whichever command running the
+	// session exited on its own.
+	var endedErr error
+wait:
+	for {
+		select {
+		case endedErr = <-tunnelEnded:
+			if !isSSHConnectError(endedErr) || o.reconnect <= 0 {
+				break wait
+			}
+			flog.Error("lost connection to %v: %v", host, endedErr)
+			for attempt := 1; ; attempt++ {
+				// The network often isn't back yet right after e.g. resuming
+				// from sleep.
+				select {
+				case <-interrupt:
+					interrupted = true
+					break wait
+				case <-time.After(reconnectDelay(attempt)):
+				}
+				logInfo(o, "reconnecting to %v (%v/%v)...", host, attempt, o.reconnect)
+				stopped, err := connect()
+				if stopped {
+					interrupted = true
+					break wait
+				}
+				if err == nil {
+					break
+				}
+				flog.Error("failed to reconnect: %v", err)
+				if attempt >= o.reconnect {
+					sessionErr = permanent(withKind(ErrSessionEnded, xerrors.Errorf("lost connection to %v: %w", host, err)))
+					break wait
+				}
+			}
+			logInfo(o, "reconnected to %v", host)
+		case endedErr = <-launchEnded:
+			break wait
+		case <-interrupt:
+			interrupted = true
+			if o.notify {
+				notify("sshcode", fmt.Sprintf("disconnected from %v", host))
+			}
+			break wait
+		case <-stop:
+			logInfo(o, "found stop file %v", o.stopFile)
+			err = os.Remove(o.stopFile)
+			if err != nil {
+				flog.Error("failed to remove stop file: %v", err)
+			}
+			interrupted = true
+			break wait
+		case <-hup:
+			if o.skipSync {
+				flog.Info("received SIGHUP, but syncing is disabled")
+				continue
+			}
+			logInfo(o, "received SIGHUP, re-syncing settings and extensions")
+			err = resync(host, o)
+			if err != nil {
+				flog.Error("failed to re-sync: %v", err)
+				continue
+			}
+			logInfo(o, "re-synced settings and extensions")
+		}
+	}
+
+	if !interrupted {
+		if o.notify {
+			notify("sshcode", fmt.Sprintf("connection to %v was lost", host))
+		}
+		// The session is over, so retrying would only start a new one.
+		if err := sessionError(endedErr); err != nil && sessionErr == nil {
+			sessionErr = permanent(err)
+		}
+	}
+
+	flog.Info("shutting down")
+	// code-server started detached to survive reconnects is still running
+	// however the session ended.
+	if (interrupted || detached) && !o.keepSession && !attached {
+		// Stopping code-server before the tunnel gives it the chance to finish
+		// writing settings and extensions, which have to be complete before
+		// they're synced back.
+		_, err = stopCodeServer(host, launchPort, shutdownGracePeriod, o)
+		if err != nil {
+			flog.Error("failed to stop code-server: %v", err)
+		}
+		// code-server exiting ends the session.
+		select {
+		case <-tunnelEnded:
+		case <-launchEnded:
+		case <-time.After(shutdownGracePeriod):
+		}
+	}
+	// Nothing may be left running while syncing back.
+	_ = sshCmd.Process.Kill()
+	if launchCmd != nil {
+		_ = launchCmd.Process.Kill()
+	}
+	if o.keepSession {
+		reconnectFlags := "--detach --remote-port " + o.remotePort
+		if o.sessionName != "" {
+			reconnectFlags += " --session-name " + o.sessionName
+		}
+		flog.Info("code-server is still running on remote port %v, "+
+			"reconnect with: sshcode %v %v", o.remotePort, reconnectFlags, host)
+	}
+	if !o.syncBack || o.skipSync {
+		return sessionErr
+	}
+
+	logInfo(o, "synchronizing VS Code back to local")
+
+	// The session is over, so retrying would only start a new one.
+	err = syncBackToLocal(host, o)
+	if err != nil {
+		return permanent(err)
+	}
+
+	return sessionErr
+}
+
+// notifyInterrupt returns a channel receiving the signals asking sshcode to end
+// the session, SIGINT and SIGTERM, the latter being how e.g. container
+// orchestrators stop it, and a function which stops their delivery.
+func notifyInterrupt() (<-chan os.Signal, func()) {
+	// signal.Notify doesn't block to deliver a signal, so without a buffer a
+	// signal arriving while nothing receives from the channel would be lost.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	return c, func() {
+		signal.Stop(c)
+	}
+}
+
+// reconnectDelay returns how long to wait before the attempt-th attempt to
+// re-establish a dropped tunnel, doubling from a second up to half a minute.
+func reconnectDelay(attempt int) time.Duration {
+	const maxDelay = 30 * time.Second
+	if attempt > 6 {
+		return maxDelay
+	}
+	d := time.Second << uint(attempt-1)
+	if d > maxDelay {
+		return maxDelay
+	}
+	return d
+}
+
+// stopFileInterval is how often the stop file is checked for.
+const stopFileInterval = time.Second
+
+// watchStopFile returns a channel which is closed once a file exists at path,
+// which is checked for every interval until done is closed.
+func watchStopFile(path string, interval time.Duration, done <-chan struct{}) <-chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if pathExists(path) {
+					close(stop)
+					return
+				}
+			}
+		}
+	}()
+	return stop
+}
+
+// syncsBack reports whether syncing in direction, one of the sync directions
+// or empty for the default, syncs back on termination.
+func syncsBack(direction string) (bool, error) {
+	switch direction {
+	case "", syncPush, syncPull:
+		return false, nil
+	case syncBoth:
+		return true, nil
+	default:
+		return false, xerrors.Errorf("invalid sync direction %q, must be one of %v, %v or %v",
+			direction, syncPush, syncPull, syncBoth,
+		)
+	}
+}
+
+// syncBackToLocal pulls the settings and extensions on host to the local ones,
+// except those skipped.
+func syncBackToLocal(host string, o options) error {
+	if !o.skipExtensions {
+		err := syncExtensions(host, true, o)
+		if err != nil {
+			return withKind(ErrSyncExtensions, xerrors.Errorf("failed to sync extensions back: %w", err))
+		}
+	}
+
+	if !o.skipSettings {
+		err := syncUserSettings(host, true, o)
+		if err != nil {
+			return withKind(ErrSyncSettings, xerrors.Errorf("failed to sync user settings back: %w", err))
+		}
+	}
+	return nil
+}
+
+// interruptedExitCode is the exit code of a shell command interrupted with
+// Ctrl-C, which ssh passes on from the remote host.
+const interruptedExitCode = 128 + 2
+
+// sessionError returns the error to report for err, the result of waiting for
+// a command running the session. Commands ended with Ctrl-C or SIGTERM ended
+// as the user wanted, so they aren't an error.
+func sessionError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if xerrors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() &&
+			(status.Signal() == syscall.SIGINT || status.Signal() == syscall.SIGTERM) {
+			return nil
+		}
+		if exitErr.ExitCode() == interruptedExitCode {
+			return nil
+		}
+	}
+	return withKind(ErrSessionEnded, xerrors.Errorf("code-server exited unexpectedly: %w", err))
+}
+
+// runDownloadScript runs dlScript with sshCmdStr, a command running a shell on
+// the remote host, and returns what it wrote to stderr, to tell connection
+// failures worth retrying apart from the others.
+func runDownloadScript(sshCmdStr string, dlScript string, o options) (string, error) {
+	var stderr bytes.Buffer
+	sshCmd := shellCommand(sshCmdStr)
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	sshCmd.Stdin = strings.NewReader(dlScript)
+	err := run(sshCmd, o)
+	return stderr.String(), err
+}
+
+// resync pushes the local settings and extensions to host, except those
+// skipped.
+func resync(host string, o options) error {
+	if !o.skipSettings {
+		err := syncUserSettings(host, false, o)
+		if err != nil {
+			return withKind(ErrSyncSettings, xerrors.Errorf("failed to sync settings: %w", err))
+		}
+	}
+
+	if !o.skipExtensions {
+		err := syncExtensions(host, false, o)
+		if err != nil {
+			return withKind(ErrSyncExtensions, xerrors.Errorf("failed to sync extensions: %w", err))
+		}
+	}
+	return nil
+}
+
+// expandPath returns an expanded version of path.
+func expandPath(path string) string {
+	path = filepath.Clean(os.ExpandEnv(path))
 
 	// Replace tilde notation in path with the home directory. You can't replace the first instance of `~` in the
 	// string with the homedir as having a tilde in the middle of a filename is valid.
@@ -235,382 +1249,2524 @@ func expandPath(path string) string {
 	return filepath.Clean(path)
 }
 
-func parseBindAddr(bindAddr string) (string, error) {
+// buildSSHFlags returns the flags every ssh connection to the host is made with,
+// which are hostFlags, the flags resolving the host argument came up with, and
+// those for o's agent forwarding, jump hosts, host key checking, known_hosts
+// file and --ssh-flags. All of them are
+// put together here, so that the ssh commands and rsync can't end up
+// connecting differently, e.g. to different ports.
+func buildSSHFlags(hostFlags string, o options) (string, error) {
+	flags := []string{o.sshFlags}
+	if o.jumpHost != "" {
+		err := validateJumpHost(o.jumpHost)
+		if err != nil {
+			return "", err
+		}
+		err = validateJumpIdentity(o.jumpIdentity)
+		if err != nil {
+			return "", err
+		}
+		flags = append([]string{jumpHostFlags(o.jumpHost, o.jumpIdentity)}, flags...)
+	} else if o.jumpIdentity != "" {
+		return "", xerrors.New("a jump identity can only be used with a jump host")
+	}
+	if o.knownHosts != "" {
+		if o.hostKeyChecking == "no" {
+			return "", xerrors.New("a known_hosts file can't be used without host key checking, which doesn't record keys")
+		}
+		flags = append([]string{"-o UserKnownHostsFile=" + shellEscape(o.knownHosts)}, flags...)
+	}
+	if o.hostKeyChecking != "" {
+		hostKeyFlags, err := hostKeyCheckingFlags(o.hostKeyChecking)
+		if err != nil {
+			return "", err
+		}
+		flags = append([]string{hostKeyFlags}, flags...)
+	}
+	if o.agentForward {
+		flags = append([]string{"-A"}, flags...)
+	}
+	if hostFlags != "" {
+		flags = append([]string{hostFlags}, flags...)
+	}
+	return strings.TrimSpace(strings.Join(flags, " ")), nil
+}
+
+// sshCommand returns the ssh command line connecting with sshFlags, as
+// returned by buildSSHFlags, up to the destination. It's also rsync's remote
+// shell.
+func sshCommand(sshFlags string) string {
+	return strings.TrimSpace("ssh " + sshFlags)
+}
+
+// remoteCommand returns the ssh command line running the shell command cmd on
+// host.
+func remoteCommand(sshFlags string, host string, cmd string) string {
+	return fmt.Sprintf("%v %v %v", sshCommand(sshFlags), host, shellEscape(cmd))
+}
+
+// tunnelCommand returns the command line of the tunnel, which runs remoteCmd on
+// host and forwards code-server's port with forwardFlags. sshBinary is the
+// command line of an ssh compatible program to run it with, like autossh with
+// its flags, and plain ssh if empty.
+func tunnelCommand(sshBinary, forwardFlags, sshFlags, host, remoteCmd string) string {
+	if sshBinary == "" {
+		sshBinary = "ssh"
+	}
+	return fmt.Sprintf("%v -tt -q %v %v %v %v",
+		sshBinary, forwardFlags, sshFlags, host, shellEscape(remoteCmd),
+	)
+}
+
+// forwardSpec returns the ssh -L argument forwarding bindAddr, as returned by
+// parseBindAddr, to remotePort on the remote host's loopback interface. IPv6
+// addresses are kept in brackets, which ssh needs to tell them from the ports.
+func forwardSpec(bindAddr string, remotePort string) string {
+	// -L takes the local end first: local_host:local_port:remote_host:remote_port.
+	return fmt.Sprintf("%v:localhost:%v", bindAddr, remotePort)
+}
+
+// extraForwardSpecs returns the ssh -L arguments of forwards, the ports given
+// to --forward as LOCAL_PORT:REMOTE_PORT, or a single port for the same one on
+// both ends. Their local ends listen on the host of bindAddr. They may not
+// clash with each other or with code-server's forward of bindAddr to
+// remotePort, either of which may not be known yet.
+func extraForwardSpecs(forwards []string, bindAddr string, remotePort string) ([]string, error) {
+	localHost, codeServerLocalPort := "127.0.0.1", ""
+	if bindAddr != "" {
+		host, port, err := net.SplitHostPort(bindAddr)
+		if err != nil {
+			return nil, err
+		}
+		if host != "" {
+			localHost = host
+		}
+		codeServerLocalPort = port
+	}
+
+	var specs []string
+	localPorts := make(map[string]bool)
+	for _, fwd := range forwards {
+		localPort, remote := fwd, fwd
+		if i := strings.Index(fwd, ":"); i >= 0 {
+			localPort, remote = fwd[:i], fwd[i+1:]
+		}
+		for _, port := range []string{localPort, remote} {
+			n, err := strconv.Atoi(port)
+			if err != nil || n < 1 || n > maxPort {
+				return nil, xerrors.Errorf("invalid forward %q, must be LOCAL_PORT:REMOTE_PORT", fwd)
+			}
+		}
+
+		switch {
+		case localPort == codeServerLocalPort:
+			return nil, xerrors.Errorf("forward %q clashes with code-server's local port %v", fwd, localPort)
+		case remote == remotePort:
+			return nil, xerrors.Errorf("forward %q clashes with code-server's remote port %v", fwd, remote)
+		case localPorts[localPort]:
+			return nil, xerrors.Errorf("local port %v is forwarded more than once", localPort)
+		}
+		localPorts[localPort] = true
+
+		specs = append(specs, forwardSpec(net.JoinHostPort(localHost, localPort), remote))
+	}
+	return specs, nil
+}
+
+// isLoopbackAddr reports whether the host of addr, as returned by
+// parseBindAddr, is only reachable from this machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseBindAddr returns the address the local end of the tunnel listens on,
+// given as [HOST][:PORT]. The host defaults to 127.0.0.1 and the port to
+// localPort, or a random free one if that's empty too.
+func parseBindAddr(bindAddr string, localPort string) (string, error) {
+	// A bare IPv6 address, or one in brackets, is a host without a port.
+	if ip := net.ParseIP(strings.Trim(bindAddr, "[]")); ip != nil && ip.To4() == nil {
+		bindAddr = "[" + ip.String() + "]:"
+	}
 	if !strings.Contains(bindAddr, ":") {
 		bindAddr += ":"
 	}
 
-	host, port, err := net.SplitHostPort(bindAddr)
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return "", err
+	}
+
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	if localPort != "" {
+		if port != "" && port != localPort {
+			return "", xerrors.Errorf("--bind gives local port %v and --local-port %v, only give one", port, localPort)
+		}
+		n, err := strconv.Atoi(localPort)
+		if err != nil || n < 1 || n > maxPort {
+			return "", xerrors.Errorf("invalid local port %q", localPort)
+		}
+		port = localPort
+	}
+
+	// The port must be known to open the browser, so ssh can't pick it.
+	if port == "" || port == "0" {
+		port, err = randomPort()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+func openBrowser(url string, o options) {
+	if o.openBrowserCmd != "" {
+		err := runOpenBrowserCmd(o.openBrowserCmd, url)
+		if err != nil {
+			flog.Error("failed to open browser: %v", err)
+		}
+		return
+	}
+
+	if env := os.Getenv(browserEnv); env != "" && o.browser == "" {
+		err := browserEnvCommand(env, url).Start()
+		if err != nil {
+			flog.Error("failed to open browser from $%v: %v", browserEnv, err)
+		}
+		return
+	}
+
+	name := o.browser
+	if name == "" {
+		name = "chrome"
+	}
+	browserPath := ""
+	if name != defaultBrowser {
+		browserPath = findBrowser(name)
+	}
+	if browserPath == "" {
+		// Only warn if the browser was asked for.
+		if o.browser != "" && o.browser != defaultBrowser {
+			flog.Error("%v not found, opening the default browser instead", o.browser)
+		}
+		err := browser.OpenURL(url)
+		if err != nil {
+			flog.Error("failed to open browser: %v", err)
+		}
+		return
+	}
+
+	warnUnreachableFromWindows(browserPath, o.bindAddr)
+
+	var openCmd *exec.Cmd
+	switch name {
+	case "firefox":
+		// Firefox has no app mode, a window of its own is the closest.
+		openCmd = exec.Command(browserPath, "-new-window", url)
+	default:
+		// Edge is based on Chromium, so it takes the same options.
+		openCmd = exec.Command(browserPath, chromeOptions(url, o)...)
+	}
+
+	// We do not use CombinedOutput because if there is no chrome instance, this will block
+	// and become the parent process instead of using an existing chrome instance.
+	err := openCmd.Start()
+	if err != nil {
+		flog.Error("failed to open browser: %v", err)
+	}
+}
+
+// runOpenBrowserCmd starts the user provided shell command cmdTmpl to open url.
+// The URL is passed to it as $1, and any {{.URL}} in it is replaced with the
+// shell quoted URL.
+func runOpenBrowserCmd(cmdTmpl string, url string) error {
+	tmpl, err := template.New("open-browser-cmd").Parse(cmdTmpl)
+	if err != nil {
+		return xerrors.Errorf("failed to parse open browser command: %w", err)
+	}
+
+	var cmdStr strings.Builder
+	err = tmpl.Execute(&cmdStr, struct{ URL string }{URL: shellEscape(url)})
+	if err != nil {
+		return xerrors.Errorf("failed to render open browser command: %w", err)
+	}
+
+	openCmd := exec.Command("sh", "-c", cmdStr.String(), "sh", url)
+	openCmd.Stdout = os.Stdout
+	openCmd.Stderr = os.Stderr
+	err = openCmd.Start()
+	if err != nil {
+		return err
+	}
+	go openCmd.Wait()
+	return nil
+}
+
+// Environment variables telling the --on-ready command about the session.
+const (
+	onReadyURLEnv  = "SSHCODE_URL"
+	onReadyHostEnv = "SSHCODE_HOST"
+)
+
+// validateOpenFile checks that file, as given to --open-file, is a path within
+// the directory code-server is started in.
+func validateOpenFile(file string) error {
+	clean := path.Clean(file)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return xerrors.Errorf("invalid file to open %q, must be a path relative to the directory code-server is started in", file)
+	}
+	return nil
+}
+
+// openFileURL returns the URL which makes code-server at baseURL open file, a
+// path relative to dir, the absolute path of the directory it's started in.
+// Workspace files are opened as the workspace, other files in an editor
+// within dir.
+func openFileURL(baseURL string, dir string, file string) (string, error) {
+	err := validateOpenFile(file)
+	if err != nil {
+		return "", err
+	}
+	u, err := neturl.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	filePath := path.Join(dir, file)
+	query := neturl.Values{}
+	if strings.HasSuffix(filePath, ".code-workspace") {
+		query.Set("workspace", filePath)
+	} else {
+		query.Set("folder", dir)
+		// Files to open once VS Code is loaded, in the format of its
+		// workbench's payload parameter.
+		fileURI := (&neturl.URL{Scheme: "vscode-remote", Host: u.Host, Path: filePath}).String()
+		query.Set("payload", fmt.Sprintf(`[["openFile",%q]]`, fileURI))
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// readyMessage returns the message pointing the user at url, where code-server
+// is ready, for when the browser isn't opened for them.
+func readyMessage(url string, password string) string {
+	msg := fmt.Sprintf("\nOpen this in your browser: %v\n", url)
+	if password != "" {
+		msg += fmt.Sprintf("Log in with password: %v\n", password)
+	}
+	return msg + "\n"
+}
+
+// sessionStatus describes a session which is up, for tools running sshcode.
+type sessionStatus struct {
+	URL  string `json:"url"`
+	Host string `json:"host"`
+	// BindAddr and LocalPort are empty when code-server is reached on the
+	// remote host directly rather than through the tunnel.
+	BindAddr   string `json:"bindAddr,omitempty"`
+	LocalPort  string `json:"localPort,omitempty"`
+	RemotePort string `json:"remotePort"`
+	Password   string `json:"password,omitempty"`
+	// PID is the process ID of sshcode, which ends the session when sent
+	// SIGINT or SIGTERM.
+	PID int `json:"pid"`
+}
+
+// writeSessionStatus writes status to w as a single line of JSON.
+func writeSessionStatus(w io.Writer, status sessionStatus) error {
+	// Encode terminates the line, so that tools can read it without waiting
+	// for the output to end.
+	return json.NewEncoder(w).Encode(status)
+}
+
+// startOnReadyHook starts the shell command cmdStr, with the URL code-server is
+// ready at and the host it runs on in its environment.
+func startOnReadyHook(cmdStr string, url string, host string) (*exec.Cmd, error) {
+	hookCmd := shellCommand(cmdStr)
+	hookCmd.Env = append(os.Environ(), onReadyURLEnv+"="+url, onReadyHostEnv+"="+host)
+	hookCmd.Stdout = os.Stdout
+	hookCmd.Stderr = os.Stderr
+	err := hookCmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return hookCmd, nil
+}
+
+// shellEscape quotes s so that a POSIX shell reads it as a single word.
+func shellEscape(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// defaultBrowser is the --browser value for the system's default browser.
+const defaultBrowser = "default"
+
+// browserPaths are the executables of the browsers --browser accepts, in order
+// of preference. Absolute paths are where they're installed on macOS and
+// Windows, or Windows as seen from WSL. 64-bit browsers are installed in
+// Program Files, 32-bit ones, and older versions of Chrome and Edge, in
+// Program Files (x86).
+var browserPaths = map[string][]string{
+	"chrome": {
+		"chrome", "google-chrome", "google-chrome-stable", "chromium", "chromium-browser",
+		"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+		"/mnt/c/Program Files/Google/Chrome/Application/chrome.exe",
+		"/mnt/c/Program Files (x86)/Google/Chrome/Application/chrome.exe",
+		"C:/Program Files/Google/Chrome/Application/chrome.exe",
+		"C:/Program Files (x86)/Google/Chrome/Application/chrome.exe",
+	},
+	"firefox": {
+		"firefox",
+		"/Applications/Firefox.app/Contents/MacOS/firefox",
+		"/mnt/c/Program Files/Mozilla Firefox/firefox.exe",
+		"/mnt/c/Program Files (x86)/Mozilla Firefox/firefox.exe",
+		"C:/Program Files/Mozilla Firefox/firefox.exe",
+		"C:/Program Files (x86)/Mozilla Firefox/firefox.exe",
+	},
+	"edge": {
+		"microsoft-edge", "microsoft-edge-stable",
+		"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+		"/mnt/c/Program Files/Microsoft/Edge/Application/msedge.exe",
+		"/mnt/c/Program Files (x86)/Microsoft/Edge/Application/msedge.exe",
+		"C:/Program Files/Microsoft/Edge/Application/msedge.exe",
+		"C:/Program Files (x86)/Microsoft/Edge/Application/msedge.exe",
+	},
+}
+
+// browserEnv is the conventional environment variable naming the user's
+// browser, used unless --browser is given.
+const browserEnv = "BROWSER"
+
+// browserEnvCommand returns the command opening url with the browser in
+// browserEnv's value. That's either the path of the browser, which may
+// contain spaces such as in /mnt/c/Program Files on WSL, or a shell command,
+// where any %s is replaced with the URL and which is passed it as the last
+// argument otherwise.
+func browserEnvCommand(value string, url string) *exec.Cmd {
+	if !strings.Contains(value, "%s") && (pathExists(value) || commandExists(value)) {
+		return exec.Command(value, url)
+	}
+	if strings.Contains(value, "%s") {
+		return shellCommand(strings.Replace(value, "%s", shellEscape(url), -1))
+	}
+	return shellCommand(value + " " + shellEscape(url))
+}
+
+// isWSLRelease reports whether the kernel release, as in
+// /proc/sys/kernel/osrelease, is that of the Windows Subsystem for Linux.
+func isWSLRelease(release string) bool {
+	return strings.Contains(strings.ToLower(release), "microsoft")
+}
+
+// isWSL reports whether sshcode runs in the Windows Subsystem for Linux.
+func isWSL() bool {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	return err == nil && isWSLRelease(string(release))
+}
+
+// warnUnreachableFromWindows warns if browserPath is a Windows browser started
+// from WSL, and the tunnel's local end at bindAddr listens on an address of
+// WSL's own network interface. Windows only reaches services in WSL on
+// localhost, which WSL forwards, so the browser might not load code-server.
+func warnUnreachableFromWindows(browserPath string, bindAddr string) {
+	if !strings.HasSuffix(browserPath, ".exe") || !isWSL() {
+		return
+	}
+	host, _, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if isLoopbackAddr(bindAddr) || (ip != nil && ip.IsUnspecified()) {
+		return
+	}
+	flog.Error("the tunnel is bound to %v, which the Windows browser may not reach, "+
+		"bind it to localhost (the default) or 0.0.0.0 to use WSL's localhost forwarding", host)
+}
+
+// findBrowser returns the executable of the named browser, or an empty string
+// if it isn't installed.
+func findBrowser(name string) string {
+	for _, path := range browserPaths[name] {
+		if strings.Contains(path, "/") {
+			if pathExists(path) {
+				return path
+			}
+			continue
+		}
+		if commandExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+func chromeOptions(url string, o options) []string {
+	// The app window keeps code-server separate from other tabs, even without
+	// the rest.
+	opts := []string{"--app=" + url}
+	if !o.allowExtensions {
+		opts = append(opts, "--disable-extensions", "--disable-plugins")
+	}
+	if !o.noIncognito {
+		opts = append(opts, "--incognito")
+	}
+	if o.chromeProfileDir != "" {
+		opts = append(opts, "--profile-directory="+o.chromeProfileDir)
+	}
+	if o.windowName != "" {
+		// Sets the window class on Linux, which is what window switchers and
+		// window managers go by, as the title comes from code-server.
+		opts = append(opts, "--class="+o.windowName)
+	}
+	return opts
+}
+
+// logLevel is how much is logged.
+type logLevel int
+
+const (
+	logQuiet logLevel = iota - 1
+	logNormal
+	logVerbose
+)
+
+// logInfo logs a routine message, unless o.logLevel is quiet.
+func logInfo(o options, format string, args ...interface{}) {
+	if o.logLevel > logQuiet {
+		flog.Info(format, args...)
+	}
+}
+
+// logCommand logs cmd when o.logLevel is verbose, with the values of
+// environment variables passed to code-server masked.
+func logCommand(o options, cmd *exec.Cmd) {
+	if o.logLevel < logVerbose {
+		return
+	}
+	flog.Info("running: %v", redactEnv(commandString(cmd), o))
+}
+
+// commandString returns cmd as it would be typed into a shell. Commands run
+// through a shell are returned as the shell sees them.
+func commandString(cmd *exec.Cmd) string {
+	if len(cmd.Args) > 1 && cmd.Args[0] == "sh" && cmd.Args[len(cmd.Args)-2] == "-c" {
+		return cmd.Args[len(cmd.Args)-1]
+	}
+	return strings.Join(cmd.Args, " ")
+}
+
+// run runs cmd, or only logs it with --dry-run.
+func run(cmd *exec.Cmd, o options) error {
+	if o.dryRun {
+		flog.Info("dry run: %v", redactEnv(commandString(cmd), o))
+		return nil
+	}
+	logCommand(o, cmd)
+	return cmd.Run()
+}
+
+// runWithTimeout is run, but stops cmd if it runs longer than timeout, zero
+// meaning no limit. cmd is asked to stop with SIGTERM first, which lets rsync
+// remove its temporary files, or keep them with --resume-sync, and is only
+// killed if it doesn't stop within shutdownGracePeriod.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration, o options) error {
+	if timeout <= 0 || o.dryRun {
+		return run(cmd, o)
+	}
+
+	logCommand(o, cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	err = cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		// Windows has no SIGTERM.
+		_ = cmd.Process.Kill()
+	}
+	select {
+	case <-done:
+	case <-time.After(shutdownGracePeriod):
+		_ = cmd.Process.Kill()
+		<-done
+	}
+	return xerrors.Errorf("%v didn't finish within %v", filepath.Base(cmd.Path), timeout)
+}
+
+// rsyncInstallHint returns how to install rsync on goos.
+func rsyncInstallHint(goos string) string {
+	switch goos {
+	case "darwin":
+		return "install it with `brew install rsync`"
+	case "windows":
+		return "install it in WSL or Git Bash, e.g. with `sudo apt install rsync` or `pacman -S rsync`"
+	default:
+		return "install it with your package manager, e.g. `sudo apt install rsync`"
+	}
+}
+
+// Checks if a command exists locally.
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+func pathExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// readinessClient returns the client checking whether code-server is ready,
+// with timeout for each request. selfSigned is whether code-server serves
+// HTTPS with the self-signed certificate it generates, which can't be
+// verified, through the ssh tunnel, which makes verifying it unnecessary.
+func readinessClient(timeout time.Duration, selfSigned bool) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		// The redirect to the login page with --auth means code-server is
+		// up, so it isn't followed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		// The probe talks to the local end of the tunnel, or straight to the
+		// remote host, so HTTP_PROXY/HTTPS_PROXY from the environment must
+		// not apply. A proxy elsewhere couldn't reach either, leaving sshcode
+		// waiting until the startup timeout.
+		Transport: &http.Transport{
+			Proxy: nil,
+			// Only skipped through the tunnel, see above.
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: selfSigned,
+			},
+		},
+	}
+}
+
+// codeServerHealthPath is code-server's health endpoint, which only responds
+// once the server is fully up.
+const codeServerHealthPath = "/healthz"
+
+// waitForCodeServer checks whether code-server at url is ready every interval
+// until it is, ctx is done or an interrupt is received, which is reported as
+// interrupted.
+func waitForCodeServer(ctx context.Context, client *http.Client, url string, interval time.Duration, interrupt <-chan os.Signal) (interrupted bool, err error) {
+	// lastErr is why code-server wasn't ready on the latest attempt.
+	var lastErr error
+	for {
+		if ctx.Err() != nil {
+			if lastErr != nil {
+				return false, withKind(ErrStartupTimeout,
+					xerrors.Errorf("code-server didn't start in time, last error: %v: %w", lastErr, ctx.Err()),
+				)
+			}
+			return false, withKind(ErrStartupTimeout, xerrors.Errorf("code-server didn't start in time: %w", ctx.Err()))
+		}
+		err = checkCodeServerReady(ctx, client, url)
+		if err == nil {
+			return false, nil
+		}
+		// A check cut off by the deadline says less than the one before it.
+		if lastErr == nil || ctx.Err() == nil {
+			lastErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(jitter(interval)):
+		case <-interrupt:
+			return true, nil
+		}
+	}
+}
+
+// checkCodeServerReady returns nil if code-server at url is ready to be opened.
+// That's when its health endpoint responds with 200. Versions without one
+// only count as ready when the page itself responds successfully, or with
+// the redirect to the login page with --auth, as a server that's still
+// starting or the tunnel without code-server behind it responds with an error.
+//
+// A server presenting a certificate signed by an unknown authority counts as
+// ready too, as that's code-server with the certificate it generates when it's
+// reached directly. No request is sent over such a connection.
+func checkCodeServerReady(ctx context.Context, client *http.Client, url string) error {
+	status, err := getStatus(ctx, client, strings.TrimSuffix(url, "/")+codeServerHealthPath)
+	if isUnknownAuthority(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == http.StatusOK:
+		return nil
+	case status != http.StatusNotFound:
+		return xerrors.Errorf("%v responded with %v", codeServerHealthPath, http.StatusText(status))
+	}
+
+	status, err = getStatus(ctx, client, url)
+	if err != nil {
+		return err
+	}
+	if status >= 400 {
+		return xerrors.Errorf("code-server responded with %v", http.StatusText(status))
+	}
+	return nil
+}
+
+// isUnknownAuthority returns whether err is a failure to verify a certificate
+// signed by an unknown authority, such as a self-signed one.
+func isUnknownAuthority(err error) bool {
+	// *url.Error can't be unwrapped before Go 1.13.
+	var urlErr *neturl.Error
+	if xerrors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var authErr x509.UnknownAuthorityError
+	return xerrors.As(err, &authErr)
+}
+
+// getStatus returns the status code of a GET of url.
+func getStatus(ctx context.Context, client *http.Client, url string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Reading the body lets the connection be reused for the next check.
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// probeTimeout returns the timeout of a single check whether code-server has
+// started, a fraction of startupTimeout so that one slow response leaves time to
+// try again.
+func probeTimeout(startupTimeout time.Duration) time.Duration {
+	timeout := startupTimeout / 5
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	if timeout > startupTimeout {
+		timeout = startupTimeout
+	}
+	return timeout
+}
+
+// jitter returns d lengthened by a random amount of up to a quarter, so that
+// repeated attempts don't happen in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d < 4 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d/4)))
+}
+
+// freeRemotePortTries is how many random ports are tried on the remote host
+// before giving up.
+const freeRemotePortTries = 10
+
+// noPortListerExitCode is the exit code of freeRemotePortScript when neither
+// ss nor netstat is installed, so it can't tell which ports are free.
+const noPortListerExitCode = 2
+
+// freeRemotePortScript returns a script which prints the first of ports which
+// nothing on the host it runs on listens on.
+func freeRemotePortScript(ports []string) string {
+	return fmt.Sprintf(`command -v ss > /dev/null || command -v netstat > /dev/null || exit %v
+listening=$({ ss -ltn || netstat -ltn; } 2> /dev/null | awk '{ print $4 }')
+for port in %v; do
+	echo "$listening" | grep -q ":$port\$" || { echo "$port"; exit 0; }
+done
+exit 1`, noPortListerExitCode, strings.Join(ports, " "))
+}
+
+// freeRemotePort picks a port on host for code-server to listen on, preferring
+// preferred if it's free. Without a way to tell which ports are free on host,
+// preferred or a random port is picked unchecked.
+func freeRemotePort(host string, preferred string, o options) (string, error) {
+	var ports []string
+	if preferred != "" {
+		ports = append(ports, preferred)
+	}
+	for i := 0; i < freeRemotePortTries; i++ {
+		ports = append(ports, strconv.Itoa(rand.Intn(maxPort-minPort+1)+minPort))
+	}
+	if o.dryRun {
+		return ports[0], nil
+	}
+
+	out, err := runRemote(host, freeRemotePortScript(ports), o)
+	if isSSHConnectError(err) {
+		return "", withKind(ErrConnect, err)
+	}
+	var exitErr *exec.ExitError
+	if xerrors.As(err, &exitErr) && exitErr.ExitCode() == noPortListerExitCode {
+		flog.Info("neither ss nor netstat is installed on %v, using remote port %v without checking it's free", host, ports[0])
+		return ports[0], nil
+	}
+	if err != nil {
+		return "", xerrors.Errorf("max number of tries exceeded: %d: %w", len(ports), err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Range of the ports randomPort and freeRemotePort pick from.
+const (
+	minPort = 1024
+	maxPort = 65535
+)
+
+// isPrivilegedPort reports whether listening on port, if it's one, needs
+// privileges on most Unix systems.
+func isPrivilegedPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < minPort
+}
+
+// randomPort picks a random port which is free locally, for the local end of
+// the tunnel.
+func randomPort() (string, error) {
+	const maxTries = 10
+	for i := 0; i < maxTries; i++ {
+		port := strconv.Itoa(rand.Intn(maxPort-minPort+1) + minPort)
+		if portFree(port) {
+			return port, nil
+		}
+		flog.Info("port taken: %v", port)
+	}
+
+	return "", xerrors.Errorf("max number of tries exceeded: %d", maxTries)
+}
+
+// portFree reports whether port can be listened on.
+func portFree(port string) bool {
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return false
+	}
+	_ = l.Close()
+	return true
+}
+
+// startSSHMaster starts an SSH master connection and waits for it to be ready.
+// It returns a new set of SSH flags for child SSH processes to use.
+func startSSHMaster(sshFlags string, host string) (string, func(), error) {
+	// The socket goes in a directory only the user can access, with a short
+	// name, as socket paths are limited to around 100 characters.
+	controlDir, err := ioutil.TempDir("", "sshcode")
+	if err != nil {
+		return "", func() {}, xerrors.Errorf("failed to create directory for control socket: %w", err)
+	}
+	controlPath := filepath.Join(controlDir, "cm")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Should the master connection die, the next connection takes its place.
+	newSSHFlags := fmt.Sprintf(`%v -o "ControlPath=%v" -o ControlMaster=auto -o ControlPersist=%v`,
+		sshFlags, controlPath, sshControlPersist,
+	)
+
+	// -MN means "start a master socket and don't open a session, just connect".
+	sshCmdStr := fmt.Sprintf(`exec %v -MNq %v`, sshCommand(newSSHFlags), host)
+	sshMasterCmd := exec.CommandContext(ctx, "sh", "-c", sshCmdStr)
+	sshMasterCmd.Stdin = os.Stdin
+	sshMasterCmd.Stderr = os.Stderr
+
+	// Gracefully stop the SSH master, and any that took its place.
+	stopSSHMaster := func() {
+		defer os.RemoveAll(controlDir)
+
+		exitCmd := exec.Command("sh", "-c", fmt.Sprintf(`%v -O exit %v`, sshCommand(newSSHFlags), host))
+		// Fails if no master is running, which is fine.
+		_ = exitCmd.Run()
+
+		if sshMasterCmd.Process != nil {
+			if sshMasterCmd.ProcessState != nil && sshMasterCmd.ProcessState.Exited() {
+				return
+			}
+			err := sshMasterCmd.Process.Signal(syscall.SIGTERM)
+			if err != nil {
+				flog.Error("failed to send SIGTERM to SSH master process: %v", err)
+			}
+		}
+		cancel()
+	}
+
+	// Start ssh master and wait. Waiting prevents the process from becoming a zombie process if it dies before
+	// sshcode does, and allows sshMasterCmd.ProcessState to be populated.
+	err = sshMasterCmd.Start()
+	go sshMasterCmd.Wait()
+	if err != nil {
+		return "", stopSSHMaster, err
+	}
+	err = checkSSHMaster(sshMasterCmd, newSSHFlags, host)
+	if err != nil {
+		stopSSHMaster()
+		return "", stopSSHMaster, xerrors.Errorf("SSH master wasn't ready on time: %w", err)
+	}
+	return newSSHFlags, stopSSHMaster, nil
+}
+
+// checkSSHMaster polls every second for 30 seconds to check if the SSH master
+// is ready.
+func checkSSHMaster(sshMasterCmd *exec.Cmd, sshFlags string, host string) error {
+	var (
+		maxTries = 30
+		sleepDur = time.Second
+		err      error
+	)
+	for i := 0; i < maxTries; i++ {
+		// Check if the master is running.
+		if sshMasterCmd.Process == nil || (sshMasterCmd.ProcessState != nil && sshMasterCmd.ProcessState.Exited()) {
+			return xerrors.Errorf("SSH master process is not running")
+		}
+
+		// Check if it's ready.
+		sshCmdStr := fmt.Sprintf(`%v -O check %v`, sshCommand(sshFlags), host)
+		sshCmd := exec.Command("sh", "-c", sshCmdStr)
+		err = sshCmd.Run()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(sleepDur)
+	}
+	return xerrors.Errorf("max number of tries exceeded: %d", maxTries)
+}
+
+// codeServerInstalled reports whether a code-server binary from a previous run
+// is cached on host.
+func codeServerInstalled(host string, o options) (bool, error) {
+	sshCmdStr := remoteCommand(o.sshFlags, host, "test -x "+codeServerPath(o))
+
+	sshCmd := shellCommand(sshCmdStr)
+	sshCmd.Stderr = os.Stderr
+	installed, err := remoteTestResult(run(sshCmd, o))
+	if err != nil {
+		return false, xerrors.Errorf("%s: %w", sshCmdStr, err)
+	}
+	return installed, nil
+}
+
+// remoteTestResult interprets err, the result of running test on the remote
+// host over ssh. The test failing means false, but ssh failing to connect or
+// to run at all is an error.
+func remoteTestResult(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if isSSHConnectError(err) {
+		return false, err
+	}
+	var exitErr *exec.ExitError
+	if xerrors.As(err, &exitErr) {
+		return false, nil
+	}
+	return false, err
+}
+
+// copyCodeServerBinary copies a code-server binary from local to remote.
+func copyCodeServerBinary(host string, localPath string, remotePath string, o options) error {
+	if err := validateIsFile(localPath); err != nil {
+		return err
+	}
+
+	var (
+		src  = localPath
+		dest = host + ":" + remotePath
+	)
+
+	return rsync(src, dest, o)
+}
+
+// handEditedSettings are the files and directories, relative to the User dir,
+// which are edited by hand rather than through VS Code. They're always synced
+// from the sending side, even if the receiving side's copy is newer, which
+// happens e.g. when the clocks of the hosts differ, and would skip them.
+var handEditedSettings = []string{"keybindings.json", "snippets/"}
+
+func syncUserSettings(host string, back bool, o options) error {
+	localConfDir, err := configDir(runtime.GOOS, o.vsCodeFlavor)
+	if err != nil {
+		return err
+	}
+	warnMissingVSCodeDir(localConfDir, "settings")
+
+	err = ensureDir(localConfDir)
+	if err != nil {
+		return err
+	}
+
+	if !back {
+		empty, err := isEmptyDir(localConfDir)
+		if err != nil {
+			return err
+		}
+		if empty {
+			flog.Error("local settings directory %v is empty, skipping the settings sync so the remote settings aren't deleted", localConfDir)
+			return nil
+		}
+
+		err = checkSyncSize(localConfDir, o.maxSyncSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	remoteSettingsDir := remoteDataPath("User/", o)
+	var (
+		src  = localConfDir + "/"
+		dest = host + ":" + remoteSettingsDir
+	)
+
+	if back {
+		dest, src = src, dest
+	}
+
+	excludes := settingsExcludes(o)
+	logInfo(o, "excluding from settings sync: %v", strings.Join(excludes, ", "))
+
+	// handEditedSettings are synced separately.
+	rsyncExcludes := excludes
+	for _, path := range handEditedSettings {
+		rsyncExcludes = append(rsyncExcludes, "/"+path)
+	}
+
+	// Append "/" to have rsync copy the contents of the dir.
+	err = rsync(src, dest, o, rsyncExcludes...)
+	if err != nil {
+		return xerrors.Errorf("excluding %v: %w", strings.Join(excludes, ", "), err)
+	}
+
+	err = rsyncPaths(src, dest, o, handEditedSettings...)
+	if err != nil {
+		return err
+	}
+
+	if o.encryptSettings {
+		return syncEncryptedSettings(host, localConfDir, remoteSettingsDir, back, o)
+	}
+	return nil
+}
+
+// settingsExcludes returns the paths left out of the settings sync, in rsync's
+// exclude syntax.
+func settingsExcludes(o options) []string {
+	excludes := []string{"workspaceStorage", "logs", "CachedData"}
+	if !o.syncTasks {
+		// User tasks tend to run local tools, which the remote host may not
+		// have. The leading "/" keeps this to the User dir's own tasks.json,
+		// the same in both directions.
+		excludes = append(excludes, "/tasks.json")
+	}
+	if o.encryptSettings {
+		for _, name := range encryptedSettingsFiles {
+			excludes = append(excludes, "/"+name)
+		}
+	}
+	return append(excludes, o.syncExcludes...)
+}
+
+// hostKeyCheckingFlags returns the ssh flags for a --host-key-checking policy,
+// one of ssh's StrictHostKeyChecking values yes, no or accept-new. As there's
+// no point in keeping keys that aren't checked, no also stops them from being
+// added to known_hosts, which suits throwaway instances.
+func hostKeyCheckingFlags(policy string) (string, error) {
+	switch policy {
+	case "yes", "accept-new":
+		return "-o StrictHostKeyChecking=" + policy, nil
+	case "no":
+		return "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null", nil
+	default:
+		return "", xerrors.Errorf("invalid host key checking policy %q, must be one of yes, no or accept-new", policy)
+	}
+}
+
+// defaultExtensionExcludes are left out of the extensions sync as they are
+// development leftovers that aren't needed to run an extension. node_modules is
+// deliberately not one of them, most extensions load their dependencies from it.
+var defaultExtensionExcludes = []string{".git", ".cache", "*.log"}
+
+func syncExtensions(host string, back bool, o options) error {
+	localExtensionsDir, err := extensionsDir(runtime.GOOS, o.vsCodeFlavor)
+	if err != nil {
+		return err
+	}
+	warnMissingVSCodeDir(localExtensionsDir, "extensions")
+
+	err = ensureDir(localExtensionsDir)
+	if err != nil {
+		return err
+	}
+
+	if !back {
+		empty, err := isEmptyDir(localExtensionsDir)
+		if err != nil {
+			return err
+		}
+		if empty {
+			flog.Error("local extensions directory %v is empty, skipping the extensions sync so the remote extensions aren't deleted", localExtensionsDir)
+			return nil
+		}
+
+		if len(o.extensions) > 0 {
+			err = warnMissingExtensions(localExtensionsDir, o.extensions)
+			if err != nil {
+				return err
+			}
+			err = checkExtensionsSyncSize(localExtensionsDir, o.extensions, o.maxSyncSize)
+		} else {
+			err = checkSyncSize(localExtensionsDir, o.maxSyncSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	remoteExtensionsDir := remoteDataPath("extensions/", o)
+
+	var (
+		src  = localExtensionsDir + "/"
+		dest = host + ":" + remoteExtensionsDir
+	)
+	if back {
+		dest, src = src, dest
+	}
+
+	var excludes []string
+	if !o.noDefaultExcludes {
+		excludes = defaultExtensionExcludes
+	}
+	if len(o.extensions) == 0 {
+		return rsync(src, dest, o, excludes...)
+	}
+
+	// Like rsync, but the excludes must come before the filter for them to
+	// apply within the selected extensions.
+	var flags []string
+	for _, path := range excludes {
+		flags = append(flags, "--exclude="+path)
+	}
+	flags = append(flags, extensionFilterFlags(o.extensions)...)
+	return runRsync(src, dest, o, append(flags, "-u"))
+}
+
+// extensionIDRegexp matches extension IDs, which are of the form
+// publisher.name.
+var extensionIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*\.[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// matchExtensionDir reports whether name, the name of a directory in the
+// extensions directory, holds the extension with ID id. VS Code names them
+// after the lowercase ID, followed by a dash and the version, like
+// ms-python.python-2019.8.30787, but the version may also be left out.
+func matchExtensionDir(name string, id string) bool {
+	name, id = strings.ToLower(name), strings.ToLower(id)
+	if name == id {
+		return true
+	}
+	if !strings.HasPrefix(name, id+"-") {
+		return false
+	}
+	// Versions start with a digit, which tells them from a longer name with
+	// the same prefix, like ms-python.python-insiders.
+	version := name[len(id)+1:]
+	return version != "" && version[0] >= '0' && version[0] <= '9'
+}
+
+// extensionFilterFlags returns the rsync filter flags limiting a sync of the
+// extensions directory to the extensions with ids, in any of their versions,
+// so that the old versions of those are deleted. The other extensions are
+// excluded, which keeps them from being deleted as well.
+func extensionFilterFlags(ids []string) []string {
+	var flags []string
+	for _, id := range ids {
+		id = strings.ToLower(id)
+		for _, dir := range []string{"/" + id + "/", "/" + id + "-[0-9]*/"} {
+			flags = append(flags, "--include="+dir, "--include="+dir+"**")
+		}
+	}
+	return append(flags, "--exclude=*")
+}
+
+// warnMissingExtensions logs a warning for each of the extensions with ids
+// which isn't installed in the local extensions directory dir.
+func warnMissingExtensions(dir string, ids []string) error {
+	names, err := readDirNames(nativePath(dir))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		found := false
+		for _, name := range names {
+			if matchExtensionDir(name, id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			flog.Error("extension %v isn't installed locally, so it can't be synced", id)
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the names of the entries of the directory dir.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// isEmptyDir reports whether the local directory dir has no entries. Pushing
+// an empty directory, such as on a machine VS Code was never used on, would
+// delete everything on the remote end.
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(nativePath(dir))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// checkSyncSize returns an error if the local directory dir is larger than
+// maxSize bytes. A maxSize of zero disables the check.
+func checkSyncSize(dir string, maxSize int64) error {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	size, err := dirSize(nativePath(dir))
+	if err != nil {
+		return xerrors.Errorf("failed to compute size of %v: %w", dir, err)
+	}
+	if size > maxSize {
+		return xerrors.Errorf("%v is %v, which exceeds the maximum sync size of %v",
+			dir, formatByteSize(size), formatByteSize(maxSize),
+		)
+	}
+	return nil
+}
+
+// checkExtensionsSyncSize is checkSyncSize for the extensions with ids in the
+// local extensions directory dir, which are all that's synced of it.
+func checkExtensionsSyncSize(dir string, ids []string, maxSize int64) error {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	names, err := readDirNames(nativePath(dir))
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, name := range names {
+		for _, id := range ids {
+			if !matchExtensionDir(name, id) {
+				continue
+			}
+			n, err := dirSize(nativePath(filepath.Join(dir, name)))
+			if err != nil {
+				return xerrors.Errorf("failed to compute size of extension %v: %w", name, err)
+			}
+			size += n
+			break
+		}
+	}
+	if size > maxSize {
+		return xerrors.Errorf("the selected extensions in %v are %v, which exceeds the maximum sync size of %v",
+			dir, formatByteSize(size), formatByteSize(maxSize),
+		)
+	}
+	return nil
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+var byteSizeUnits = []string{"B", "K", "M", "G", "T"}
+
+// parseByteSize parses a size such as "512", "100K" or "1.5G". Units are
+// powers of 1024 and may be followed by "B" or "iB".
+func parseByteSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+
+	multiplier := 1.0
+	for i := len(byteSizeUnits) - 1; i > 0; i-- {
+		if strings.HasSuffix(str, byteSizeUnits[i]) {
+			str = strings.TrimSuffix(str, byteSizeUnits[i])
+			multiplier = math.Pow(1024, float64(i))
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || n < 0 {
+		return 0, xerrors.Errorf("invalid size %q", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// formatByteSize formats size in a human readable form, e.g. "1.5G".
+func formatByteSize(size int64) string {
+	i := 0
+	n := float64(size)
+	for n >= 1024 && i < len(byteSizeUnits)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%v", n, byteSizeUnits[i])
+}
+
+// rsyncVersionRegexp matches the major and minor version in the output of
+// rsync --version.
+var rsyncVersionRegexp = regexp.MustCompile(`version (\d+)\.(\d+)`)
+
+// rsyncVersionAtLeast reports whether the output of rsync --version shows a
+// version of at least major.minor.
+func rsyncVersionAtLeast(versionOutput string, major int, minor int) bool {
+	m := rsyncVersionRegexp.FindStringSubmatch(versionOutput)
+	if m == nil {
+		return false
+	}
+	gotMajor, _ := strconv.Atoi(m[1])
+	gotMinor, _ := strconv.Atoi(m[2])
+	return gotMajor > major || gotMajor == major && gotMinor >= minor
+}
+
+var (
+	progress2Once sync.Once
+	hasProgress2  bool
+)
+
+// rsyncHasProgress2 reports whether the local rsync supports --info=progress2,
+// which was added in 3.1. macOS ships an older one.
+func rsyncHasProgress2() bool {
+	progress2Once.Do(func() {
+		out, err := exec.Command("rsync", "--version").Output()
+		hasProgress2 = err == nil && rsyncVersionAtLeast(string(out), 3, 1)
+	})
+	return hasProgress2
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// rsyncPartialDir is where rsync keeps interrupted transfers with --resume-sync,
+// relative to the directory of each file.
+const rsyncPartialDir = ".rsync-partial"
+
+func rsync(src string, dest string, o options, excludePaths ...string) error {
+	excludeFlags := make([]string, len(excludePaths))
+	for i, path := range excludePaths {
+		excludeFlags[i] = "--exclude=" + path
+	}
+	// Only update newer directories to keep things simple.
+	return runRsync(src, dest, o, append(excludeFlags, "-u"))
+}
+
+// rsyncPaths syncs only the given paths in src to dest, whether or not dest has
+// newer versions of them. Paths of directories must end with "/".
+func rsyncPaths(src string, dest string, o options, paths ...string) error {
+	var filterFlags []string
+	for _, path := range paths {
+		filterFlags = append(filterFlags, "--include=/"+path)
+		if strings.HasSuffix(path, "/") {
+			filterFlags = append(filterFlags, "--include=/"+path+"**")
+		}
+	}
+	// Files excluded like this are also kept from being deleted.
+	filterFlags = append(filterFlags, "--exclude=*")
+	return runRsync(src, dest, o, filterFlags)
+}
+
+// runRsync runs rsync from src to dest with flags in addition to the ones used
+// for every sync.
+func runRsync(src string, dest string, o options, flags []string) error {
+	if o.syncPreview {
+		// Only show what would be transferred or deleted.
+		flags = append(flags, "--dry-run", "--itemize-changes")
+	}
+	if o.resumeSync {
+		// Keep partially transferred files so that the next attempt resumes
+		// them. rsync protects a relative partial dir from --delete.
+		flags = append(flags, "--partial", "--partial-dir="+rsyncPartialDir)
+	}
+
+	// rsync lists the files it transfers in verbose mode, which is too much
+	// for large extension directories otherwise. On a terminal, a single line
+	// with the overall progress is shown instead.
+	archiveFlags := "-azr"
+	switch {
+	case o.logLevel == logVerbose || o.syncPreview:
+		archiveFlags = "-azvr"
+	case o.logLevel == logNormal && isTerminal(os.Stdout) && rsyncHasProgress2():
+		flags = append(flags, "--info=progress2")
+	}
+
+	if !o.noDelete {
+		// This is more unsafe, but it's obnoxious having to enter VS Code
+		// locally in order to properly delete an extension.
+		flags = append(flags, "--delete")
+	}
+
+	// The user's flags come last, so that they can override the ones before.
+	userFlags, err := splitShellWords(o.rsyncFlags)
+	if err != nil {
+		return xerrors.Errorf("invalid rsync flags: %w", err)
+	}
+	flags = append(flags, archiveFlags,
+		"-e", sshCommand(o.sshFlags),
+		// Sync times to keep things simple.
+		"--times",
+		"--copy-unsafe-links",
+		"-zz",
+	)
+	cmd := exec.Command("rsync", append(append(flags, userFlags...), src, dest)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = rsyncError(runWithTimeout(cmd, o.syncTimeout, o))
+	if err != nil {
+		return xerrors.Errorf("failed to rsync '%s' to '%s': %w", src, dest, err)
+	}
+
+	return nil
+}
+
+// rsyncVanishedExitCode is rsync's exit code for a transfer which is complete
+// except for source files that vanished while it ran, like an extension's
+// logs being rotated. That's no reason to fail the sync.
+const rsyncVanishedExitCode = 24
+
+// rsyncExitCodes describe the exit codes of rsync errors which are worth
+// telling apart.
+var rsyncExitCodes = map[int]string{
+	1:   "syntax or usage error, check --rsync-flags",
+	2:   "protocol incompatibility",
+	10:  "error in socket I/O",
+	11:  "error in file I/O",
+	12:  "error in the protocol data stream, is rsync installed on the remote host?",
+	20:  "interrupted",
+	23:  "partial transfer due to an error, some files weren't synced",
+	30:  "timeout in data send or receive",
+	255: "ssh failed to connect",
+}
+
+// rsyncError returns the error to report for err, the result of running rsync.
+// Vanished files are only warned about, and the other exit codes are described
+// where rsyncExitCodes knows them.
+func rsyncError(err error) error {
+	var exitErr *exec.ExitError
+	if !xerrors.As(err, &exitErr) {
+		return err
+	}
+	code := exitErr.ExitCode()
+	if code == rsyncVanishedExitCode {
+		flog.Error("some files vanished while syncing them, which is fine, e.g. for logs that were rotated")
+		return nil
+	}
+	if desc, ok := rsyncExitCodes[code]; ok {
+		return xerrors.Errorf("%v: %w", desc, err)
+	}
+	return err
+}
+
+// codeServerCommand returns the remote command which starts code-server in dir.
+//
+// The flags are those of code-server 2 and later, which serves plain HTTP
+// unless given a certificate. Older versions served HTTPS by default and needed
+// --allow-http and --no-auth instead, they are no longer supported.
+func codeServerCommand(dir string, o options) string {
+	listenHost, auth := "127.0.0.1", "none"
+	if o.remoteAccessible {
+		listenHost = "0.0.0.0"
+	}
+	if o.password != "" {
+		auth = "password"
+	}
+	cmd := fmt.Sprintf("%v %v --host %v --auth %v --port=%v", codeServerPath(o), parseRemoteDir(dir), listenHost, auth, o.remotePort)
+	if o.tls {
+		// Without a path, code-server generates a self-signed certificate.
+		cmd += " --cert"
+	}
+	if o.sessionName != "" || o.userDataDir != "" {
+		dataDir := remoteDataDir(o)
+		if !path.IsAbs(dataDir) {
+			dataDir = "~/" + dataDir
+		}
+		cmd += fmt.Sprintf(" --user-data-dir %v --extensions-dir %v/extensions", dataDir, dataDir)
+	}
+	if o.codeServerFlags != "" {
+		// Left for the remote shell to split, like --ssh-flags locally. The
+		// whole command is quoted when passed to ssh, so no quoting is lost.
+		cmd += " " + o.codeServerFlags
+	}
+	if o.remoteIonice != "" {
+		cmd = fmt.Sprintf("ionice -c %v %v", o.remoteIonice, cmd)
+	}
+	if o.remoteNice != 0 {
+		cmd = fmt.Sprintf("nice -n %v %v", o.remoteNice, cmd)
+	}
+	if env := codeServerEnv(o); len(env) > 0 {
+		// env rather than plain assignments, so the command still works when
+		// run through e.g. nohup.
+		cmd = fmt.Sprintf("env %v %v", strings.Join(env, " "), cmd)
+	}
+	return cmd
+}
+
+// remoteDirPrefixRegexp matches the start of a remote directory which the remote
+// shell should expand, a ~ or ~user, or an environment variable.
+var remoteDirPrefixRegexp = regexp.MustCompile(`^(~[A-Za-z0-9_.-]*|\$[A-Za-z_][A-Za-z0-9_]*|\$\{[A-Za-z_][A-Za-z0-9_]*\})`)
+
+// parseRemoteDir returns dir quoted for the remote shell. A leading ~, ~user or
+// environment variable such as $HOME is left for the remote shell to expand,
+// everything else is quoted, so that e.g. "~/my projects" is a single argument.
+func parseRemoteDir(dir string) string {
+	prefix := remoteDirPrefixRegexp.FindString(dir)
+	rest := dir[len(prefix):]
+	if rest != "" && !strings.HasPrefix(rest, "/") {
+		// The prefix isn't a whole path component, like in "~ old", so it
+		// isn't expanded by the shell either.
+		prefix, rest = "", dir
+	}
+	if strings.HasPrefix(prefix, "$") {
+		// Keeps spaces in the variable's value from splitting the path.
+		prefix = `"` + prefix + `"`
+	}
+	if prefix != "" && rest != "" {
+		// A ~ is only expanded when followed by an unquoted slash.
+		prefix, rest = prefix+"/", rest[1:]
+	}
+	if rest == "" {
+		return prefix
+	}
+	return prefix + shellEscape(rest)
+}
+
+// envNameRegexp matches valid environment variable names.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// passthroughEnv returns NAME=value assignments, escaped for the remote shell,
+// for each of the named local environment variables that is set.
+func passthroughEnv(names []string) []string {
+	var env []string
+	for _, name := range names {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		env = append(env, name+"="+shellEscape(v))
+	}
+	return env
+}
+
+// codeServerEnv returns the NAME=value assignments, escaped for the remote shell,
+// of the environment code-server is started with.
+func codeServerEnv(o options) []string {
+	env := passthroughEnv(o.envPassthrough)
+	if o.password != "" {
+		env = append(env, "PASSWORD="+shellEscape(o.password))
+	}
+	return env
+}
+
+// redactEnv masks the values codeServerEnv puts in the remote command cmd, so
+// it can be logged without leaking them.
+func redactEnv(cmd string, o options) string {
+	for _, assignment := range codeServerEnv(o) {
+		name := assignment[:strings.Index(assignment, "=")]
+		cmd = strings.Replace(cmd, assignment, name+"=********", -1)
+		// Also once quoted again, for the local shell.
+		cmd = strings.Replace(cmd, strings.Replace(assignment, "'", `'\''`, -1), name+"=********", -1)
+	}
+	return cmd
+}
+
+// passwordEnv is the environment variable to set the password of --auth with,
+// rather than a flag, which would show up in the process list.
+const passwordEnv = "SSHCODE_PASSWORD"
+
+// codeServerPassword returns the password for code-server's password
+// authentication, from passwordEnv if set or else a random one.
+func codeServerPassword() (string, error) {
+	if password := os.Getenv(passwordEnv); password != "" {
+		return password, nil
+	}
+	return randomPassword()
+}
+
+// randomPassword returns a password for code-server's password authentication.
+func randomPassword() (string, error) {
+	b := make([]byte, 18)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sshHostname returns the hostname part of an ssh destination of the form
+// [user@]hostname.
+func sshHostname(host string) string {
+	return host[strings.LastIndex(host, "@")+1:]
+}
+
+// ioniceClasses maps the names of the I/O scheduling classes to their number.
+var ioniceClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// parseIoniceClass returns the number of the I/O scheduling class, given by
+// name or number, for use with ionice -c.
+func parseIoniceClass(class string) (string, error) {
+	if n, ok := ioniceClasses[class]; ok {
+		return n, nil
+	}
+	for _, n := range ioniceClasses {
+		if class == n {
+			return n, nil
+		}
+	}
+	return "", xerrors.Errorf("invalid I/O scheduling class %q, must be one of realtime (1), best-effort (2) or idle (3)", class)
+}
+
+// pruneCommand returns a shell command which removes the cached code-server
+// binaries other than the one at codeServerPath, which is a hard link to the
+// current one.
+func pruneCommand(codeServerPath string) string {
+	paths := newDownloadPaths(codeServerPath)
+	return fmt.Sprintf(`find %v -maxdepth 1 -type f -name "*-linux*" ! -samefile %v -print -delete`,
+		paths.dir, paths.binary,
+	)
+}
+
+// pruneCodeServerBinaries removes the code-server binaries cached on host
+// other than the current one.
+func pruneCodeServerBinaries(host string, o options) error {
+	sshCmdStr := remoteCommand(o.sshFlags, host, pruneCommand(codeServerPath(o)))
+
+	sshCmd := shellCommand(sshCmdStr)
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = os.Stderr
+	err := run(sshCmd, o)
+	if err != nil {
+		return xerrors.Errorf("%s: %w", sshCmdStr, err)
+	}
+	return nil
+}
+
+// codeServerPattern returns a pgrep pattern matching a code-server started by
+// sshcode on port, or on any port if port is empty.
+func codeServerPattern(port string) string {
+	name := codeServerName
+	// The brackets stop the pattern from matching the shell running it.
+	pattern := fmt.Sprintf("[%v]%v.*--port=%v", name[:1], name[1:], port)
+	if port != "" {
+		// Keeps e.g. port 8443 from matching 84430.
+		pattern += "( |$)"
+	}
+	return pattern
+}
+
+// matchCodeServerCmd returns the shell command line running cmd, pgrep or pkill
+// with its flags, on the code-servers started by sshcode on port. Only the
+// current user's processes match, as other users of a shared host may run
+// code-server on the same port.
+func matchCodeServerCmd(cmd string, port string) string {
+	return fmt.Sprintf(`%v -u "$(id -u)" -f "%v"`, cmd, codeServerPattern(port))
+}
+
+// killCodeServerCmd returns a shell command which kills the code-server started
+// by sshcode on port, if there is one.
+func killCodeServerCmd(port string) string {
+	return matchCodeServerCmd("pkill", port) + " || true"
+}
+
+// codeServerRunning reports whether a code-server started by sshcode, possibly
+// from another machine, is running on host on o.remotePort.
+func codeServerRunning(host string, o options) (bool, error) {
+	out, err := runRemote(host, matchCodeServerCmd("pgrep", o.remotePort)+" > /dev/null && echo running || true", o)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "running", nil
+}
+
+// stopCodeServerScript returns a script which sends SIGTERM to the code-server
+// started by sshcode on port, or to all of them if port is empty, waits up to
+// grace for them to exit and kills those that don't. It prints "stopped" if
+// there was anything to stop.
+func stopCodeServerScript(port string, grace time.Duration) string {
+	return fmt.Sprintf(`%v || exit 0
+i=0
+while %v > /dev/null; do
+	if [ $i -ge %d ]; then
+		%v
+		break
+	fi
+	sleep 1
+	i=$((i+1))
+done
+echo stopped`,
+		matchCodeServerCmd("pkill -TERM", port),
+		matchCodeServerCmd("pgrep", port),
+		int(grace.Seconds()),
+		matchCodeServerCmd("pkill -KILL", port),
+	)
+}
+
+// stopCodeServer stops the code-server started by sshcode on port on host, or
+// all of them if port is empty, giving them grace to shut down cleanly. It
+// reports whether there was anything to stop.
+func stopCodeServer(host string, port string, grace time.Duration, o options) (bool, error) {
+	script := stopCodeServerScript(port, grace)
+	if o.dryRun {
+		flog.Info("dry run: %v", script)
+		return false, nil
+	}
+
+	out, err := runRemote(host, script, o)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "stopped", nil
+}
+
+// startDetachedCodeServer starts code-server on the remote host in its own
+// session so it keeps running after the SSH connection goes away. If a
+// code-server is already running on port it is left as is.
+func startDetachedCodeServer(host string, codeServerCmd string, o options) error {
+	script := fmt.Sprintf(`%v > /dev/null || { setsid nohup %v > %v 2>&1 < /dev/null & }`,
+		matchCodeServerCmd("pgrep", o.remotePort), codeServerCmd, codeServerLogPath(o),
+	)
+
+	sshCmd := shellCommand(remoteCommand(o.sshFlags, host, script))
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = os.Stderr
+	err := run(sshCmd, o)
+	if err != nil {
+		return xerrors.Errorf("%s: %w", redactEnv(script, o), err)
+	}
+	return nil
+}
+
+// startCodeServerOnAssignedPort starts code-server on host with the command
+// codeServerCmd, which must make it listen on a port assigned by the OS, and
+// returns the port it ended up listening on.
+func startCodeServerOnAssignedPort(sshFlags string, host string, codeServerCmd string, timeout time.Duration) (*exec.Cmd, string, error) {
+	// code-server is stopped once ssh's stdin is closed, which happens at the
+	// latest when sshcode exits, since it has no terminal to hang up.
+	sshCmdStr := remoteCommand("-q "+sshFlags, host,
+		codeServerCmd+" & pid=$!; (cat > /dev/null; kill $pid) > /dev/null 2>&1 & wait $pid",
+	)
+
+	sshCmd := shellCommand(sshCmdStr)
+	sshCmd.Stderr = os.Stderr
+	// The pipe is never written to, it only needs to stay open as long as
+	// sshCmd is around.
+	_, err := sshCmd.StdinPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	stdout, err := sshCmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	err = sshCmd.Start()
+	if err != nil {
+		return nil, "", err
+	}
+
+	select {
+	case port, ok := <-scanListeningPort(stdout, os.Stdout):
+		if !ok {
+			return nil, "", xerrors.New("code-server exited before it started listening")
+		}
+		return sshCmd, port, nil
+	case <-time.After(timeout):
+		_ = sshCmd.Process.Kill()
+		return nil, "", xerrors.Errorf("code-server didn't report its port within %v", timeout)
+	}
+}
+
+// listeningURLRegexp matches the URL code-server prints once it is listening.
+var listeningURLRegexp = regexp.MustCompile(`https?://[^\s/]+:(\d+)`)
+
+// scanListeningPort copies r to w and sends the port of the first listening
+// URL found in r. The channel is closed without a port if r ends before that.
+func scanListeningPort(r io.Reader, w io.Writer) <-chan string {
+	portc := make(chan string, 1)
+	go func() {
+		defer close(portc)
+
+		var (
+			br    = bufio.NewReader(r)
+			found = false
+		)
+		for {
+			line, err := br.ReadString('\n')
+			_, _ = io.WriteString(w, line)
+			if !found {
+				m := listeningURLRegexp.FindStringSubmatch(line)
+				if m != nil && m[1] != osAssignedPort {
+					portc <- m[1]
+					found = true
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return portc
+}
+
+const (
+	// downloadBaseURL is where code-server releases are downloaded from unless
+	// other mirrors are given, and the last mirror tried otherwise.
+	downloadBaseURL = "https://codesrv-ci.cdr.sh/"
+	// defaultDownloadURL is the default URL of the latest release.
+	defaultDownloadURL = downloadBaseURL + "latest-linux"
+	// downloadURLEnv is the environment variable setting the default of
+	// --download-url.
+	downloadURLEnv = "SSHCODE_DOWNLOAD_URL"
+)
+
+// codeServerVersionRegexp matches the code-server versions which can be pinned.
+var codeServerVersionRegexp = regexp.MustCompile(`^v?[0-9][0-9A-Za-z.-]*$`)
+
+// releaseFile returns the name of the code-server release file for version, or
+// of the latest release if version is empty.
+func releaseFile(version string) string {
+	if version == "" {
+		return "latest-linux"
+	}
+	return "v" + strings.TrimPrefix(version, "v") + "-linux"
+}
+
+// downloadURLs parses a comma separated list of mirrors to download code-server
+// from, in the order to try them. The default URL of version is added as the
+// last one unless it's already listed.
+//
+// Without a version, mirrors are URLs of the latest release. With one, they're
+// base URLs the release file of version is appended to, like the default
+// server, so that a mirror can't install another release under its name.
+func downloadURLs(mirrors string, version string) []string {
+	defaultURL := downloadBaseURL + releaseFile(version)
+
+	var urls []string
+	hasDefault := false
+	for _, url := range strings.Split(mirrors, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if version != "" {
+			url = strings.TrimSuffix(url, "/") + "/" + releaseFile(version)
+		}
+		if url == defaultURL {
+			hasDefault = true
+		}
+		urls = append(urls, url)
+	}
+	if !hasDefault {
+		urls = append(urls, defaultURL)
+	}
+	return urls
+}
+
+const (
+	// checksumFailedExitCode is the exit code of the download script when the
+	// downloaded code-server doesn't match its checksum.
+	checksumFailedExitCode = 3
+	// checksumMissingExitCode is the exit code of the download script when the
+	// checksum of the downloaded code-server can't be downloaded.
+	checksumMissingExitCode = 4
+)
+
+// downloadPaths are the paths on the remote host the download script works with.
+type downloadPaths struct {
+	// binary is where code-server is installed.
+	binary string
+	// dir is the directory of binary, which releases are downloaded to.
+	dir string
+	// versionFile records the version of binary, if one was pinned.
+	versionFile string
+}
+
+// newDownloadPaths returns the paths the download script uses to install
+// code-server at codeServerPath. Remote paths are slash separated whatever the
+// local OS, and may start with a ~ for the remote shell to expand, so they
+// can't be taken apart with filepath.
+func newDownloadPaths(codeServerPath string) downloadPaths {
+	return downloadPaths{
+		binary:      codeServerPath,
+		dir:         path.Dir(codeServerPath),
+		versionFile: codeServerPath + ".version",
+	}
+}
+
+// downloadScript returns a script which downloads code-server to codeServerPath
+// from the first of urls that works, and creates dataDir, relative to the home
+// directory unless absolute, for the settings and extensions to be synced to. If killPort is
+// set, the code-server started by sshcode on that port is stopped, others are
+// left running.
+//
+// If version is set, it's recorded next to codeServerPath so that the download
+// is skipped when that version is already installed. Otherwise the latest
+// release is downloaded if it's newer than the installed one.
+//
+// The release for the remote host's architecture is downloaded, by appending a
+// suffix such as -arm64 to urls, except for x86_64.
+//
+// Downloads use curl, or wget where there's no curl. curl only downloads a
+// release that's newer than the one already downloaded.
+//
+// If verifyChecksum is set, the download is checked against the SHA-256
+// checksum published next to it, with the same URL and a .sha256 suffix, before
+// it's installed.
+func downloadScript(codeServerPath string, dataDir string, killPort string, urls []string, version string, verifyChecksum bool) string {
+	paths := newDownloadPaths(codeServerPath)
+	dataDirArg := shellEscape(dataDir)
+	if !path.IsAbs(dataDir) {
+		dataDirArg = `"$HOME"/` + dataDirArg
+	}
+
+	killCmd := ""
+	if killPort != "" {
+		killCmd = killCodeServerCmd(killPort)
+	}
+
+	checksumCmd := ""
+	if verifyChecksum {
+		checksumCmd = fmt.Sprintf(`rm -f "$file.sha256"
+if ! fetch "$url.sha256" "$file.sha256"; then
+	echo "failed to download the checksum from $url.sha256, pass --skip-checksum if the mirror doesn't publish one"
+	exit %v
+fi
+if ! echo "$(cut -d ' ' -f 1 < "$file.sha256")  $file" | sha256sum -c -; then
+	rm -f "$file"
+	echo "checksum verification of code-server from $url failed"
+	exit %v
+fi`, checksumMissingExitCode, checksumFailedExitCode)
+	}
+
+	quotedURLs := make([]string, len(urls))
+	for i, url := range urls {
+		quotedURLs[i] = shellEscape(url)
+	}
+
+	return fmt.Sprintf(
+		`set -euxo pipefail || exit 1
+
+case "$(uname -m)" in
+	x86_64 | amd64) arch_suffix="" ;;
+	aarch64 | arm64) arch_suffix="-arm64" ;;
+	armv7l) arch_suffix="-armv7" ;;
+	*)
+		echo "Unsupported server architecture $(uname -m). code-server only has releases for x86_64, arm64 and armv7l systems."
+		exit 1
+		;;
+esac
+%[1]v
+mkdir -p %[2]v %[3]v
+cd %[3]v
+version=%[4]v
+if [ -n "$version" ] && [ -x %[5]v ] && [ "$(cat %[6]v 2>/dev/null)" = "$version" ]; then
+	echo "code-server $version is already installed"
+	exit 0
+fi
+if command -v curl > /dev/null 2>&1; then
+	fetch() {
+		if [ -f "$2" ]; then
+			curl -fL -z "$2" -o "$2" "$1"
+		else
+			curl -fL -o "$2" "$1"
+		fi
+	}
+elif command -v wget > /dev/null 2>&1; then
+	fetch() {
+		wget -q -O "$2.part" "$1" && mv -f "$2.part" "$2" || { rm -f "$2.part"; return 1; }
+	}
+else
+	echo "neither curl nor wget is installed on the remote host, install one of them to download code-server"
+	exit 1
+fi
+file=%[7]v"$arch_suffix"
+downloaded=""
+for mirror in %[8]v; do
+	url="$mirror$arch_suffix"
+	if fetch "$url" "$file"; then
+		downloaded=1
+		break
+	fi
+	echo "failed to download code-server from $url"
+done
+[ -z "$downloaded" ] && echo "failed to download code-server from any mirror" && exit 1
+%[9]v
+[ -f %[5]v ] && rm %[5]v
+ln "$file" %[5]v
+chmod +x %[5]v
+if [ -n "$version" ]; then
+	echo "$version" > %[6]v
+else
+	rm -f %[6]v
+fi`,
+		killCmd,
+		dataDirArg,
+		paths.dir,
+		shellEscape(version),
+		paths.binary,
+		paths.versionFile,
+		shellEscape(releaseFile(version)),
+		strings.Join(quotedURLs, " "),
+		checksumCmd,
+	)
+}
+
+// ensureDir creates a directory if it does not exist.
+func ensureDir(path string) error {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// This fixes a issue where Go reads `/c/` as `C:\c\` and creates
+		// empty directories on the client that don't need to exist.
+		path = nativePath(path)
+		err = os.MkdirAll(path, 0750)
+	}
+
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	if host == "" {
-		host = "127.0.0.1"
-	}
+	return nil
+}
 
-	if port == "" {
-		port, err = randomPort()
+// nativePath converts the msys style paths used for the local VS Code
+// directories on Windows, e.g. `/c/Users`, to ones Go understands.
+func nativePath(path string) string {
+	if runtime.GOOS == "windows" && strings.HasPrefix(path, "/c/") {
+		return "C:" + path[2:]
 	}
+	return path
+}
+
+// validateIsFile tries to stat the specified path and ensure it's a file.
+func validateIsFile(path string) error {
+	info, err := os.Stat(path)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	return net.JoinHostPort(host, port), nil
+	if info.IsDir() {
+		return xerrors.New("path is a directory")
+	}
+	return nil
 }
 
-func openBrowser(url string) {
-	var openCmd *exec.Cmd
-
-	const (
-		macPath = "/Applications/Google Chrome.app/Contents/MacOS/Google Chrome"
-		wslPath = "/mnt/c/Program Files (x86)/Google/Chrome/Application/chrome.exe"
-		winPath = "C:/Program Files (x86)/Google/Chrome/Application/chrome.exe"
-	)
-
+// parseHost parses the host argument. If 'gcp:' is prefixed to the
+// host then a lookup is done using gcloud to determine the external IP and any
+// additional SSH arguments that should be used for ssh commands. Otherwise, host
+// is returned, without a :port suffix, which is turned into a -p flag.
+func parseHost(host string, o options) (parsedHost string, additionalFlags string, err error) {
+	host = strings.TrimSpace(host)
 	switch {
-	case commandExists("chrome"):
-		openCmd = exec.Command("chrome", chromeOptions(url)...)
-	case commandExists("google-chrome"):
-		openCmd = exec.Command("google-chrome", chromeOptions(url)...)
-	case commandExists("google-chrome-stable"):
-		openCmd = exec.Command("google-chrome-stable", chromeOptions(url)...)
-	case commandExists("chromium"):
-		openCmd = exec.Command("chromium", chromeOptions(url)...)
-	case commandExists("chromium-browser"):
-		openCmd = exec.Command("chromium-browser", chromeOptions(url)...)
-	case pathExists(macPath):
-		openCmd = exec.Command(macPath, chromeOptions(url)...)
-	case pathExists(wslPath):
-		openCmd = exec.Command(wslPath, chromeOptions(url)...)
-	case pathExists(winPath):
-		openCmd = exec.Command(winPath, chromeOptions(url)...)
+	case strings.HasPrefix(host, "gcp:"):
+		instance := strings.TrimPrefix(host, "gcp:")
+		return resolveGCPHost(instance, o)
+	case strings.HasPrefix(host, "aws:"):
+		instance := strings.TrimPrefix(host, "aws:")
+		return parseAWSSSHCmd(instance)
+	case strings.HasPrefix(host, "azure:"):
+		vm := strings.TrimPrefix(host, "azure:")
+		return parseAzureSSHCmd(vm)
+	case strings.HasPrefix(host, "do:"):
+		droplet := strings.TrimPrefix(host, "do:")
+		return parseDOSSHCmd(droplet)
 	default:
-		err := browser.OpenURL(url)
+		host, port, err := splitHostPort(host)
 		if err != nil {
-			flog.Error("failed to open browser: %v", err)
+			return "", "", err
 		}
-		return
-	}
-
-	// We do not use CombinedOutput because if there is no chrome instance, this will block
-	// and become the parent process instead of using an existing chrome instance.
-	err := openCmd.Start()
-	if err != nil {
-		flog.Error("failed to open browser: %v", err)
+		if port != "" {
+			return host, "-p " + port, nil
+		}
+		return host, "", nil
 	}
 }
 
-func chromeOptions(url string) []string {
-	return []string{"--app=" + url, "--disable-extensions", "--disable-plugins", "--incognito"}
+// cloudCLI is a cloud provider's CLI which hosts with a prefix are resolved
+// with.
+type cloudCLI struct {
+	command string
+	name    string
+	// installURL documents how to install it.
+	installURL string
 }
 
-// Checks if a command exists locally.
-func commandExists(name string) bool {
-	_, err := exec.LookPath(name)
-	return err == nil
+// cloudCLIs are the CLIs by the prefixes of the host arguments resolved with
+// them, which all take the instance as [user@]instance.
+var cloudCLIs = map[string]cloudCLI{
+	"gcp:":   {"gcloud", "Google Cloud CLI", "https://cloud.google.com/sdk/docs/install"},
+	"aws:":   {"aws", "AWS CLI", "https://docs.aws.amazon.com/cli/latest/userguide/getting-started-install.html"},
+	"azure:": {"az", "Azure CLI", "https://learn.microsoft.com/cli/azure/install-azure-cli"},
+	"do:":    {"doctl", "DigitalOcean CLI", "https://docs.digitalocean.com/reference/doctl/how-to/install/"},
 }
 
-func pathExists(name string) bool {
-	_, err := os.Stat(name)
-	return err == nil
+// checkCloudCLI returns an error explaining how to install the CLI hosts with
+// prefix are resolved with if it's missing. As the CLIs are run in a login
+// shell, those only on its $PATH, e.g. set in ~/.profile, count as well.
+func checkCloudCLI(prefix string) error {
+	cli := cloudCLIs[prefix]
+	if commandExists(cli.command) || shellCommand("command -v "+cli.command).Run() == nil {
+		return nil
+	}
+	return xerrors.Errorf("%v hosts are resolved with the %v, but %v wasn't found in $PATH, install it as described at %v",
+		prefix, cli.name, cli.command, cli.installURL,
+	)
 }
 
-// randomPort picks a random port to start code-server on.
-func randomPort() (string, error) {
-	const (
-		minPort  = 1024
-		maxPort  = 65535
-		maxTries = 10
-	)
-	for i := 0; i < maxTries; i++ {
-		port := rand.Intn(maxPort-minPort+1) + minPort
-		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-		if err == nil {
-			_ = l.Close()
-			return strconv.Itoa(port), nil
+// withUser returns the host argument host with user to log in as, unless host
+// already names one. With a cloud prefix, the user goes in front of the
+// instance, so that it replaces the provider's default user.
+func withUser(host string, user string) string {
+	host = strings.TrimSpace(host)
+	if user == "" || strings.Contains(host, "@") {
+		return host
+	}
+	for prefix := range cloudCLIs {
+		if strings.HasPrefix(host, prefix) {
+			return prefix + user + "@" + strings.TrimPrefix(host, prefix)
 		}
-		flog.Info("port taken: %d", port)
 	}
+	return user + "@" + host
+}
 
-	return "", xerrors.Errorf("max number of tries exceeded: %d", maxTries)
+// splitUser splits a cloud instance given as [user@]name into the user, empty
+// without one, and the name.
+func splitUser(instance string) (user string, name string) {
+	if i := strings.LastIndex(instance, "@"); i >= 0 {
+		return instance[:i], instance[i+1:]
+	}
+	return "", instance
 }
 
-// checkSSHDirectory performs sanity and safety checks on sshDirectory, and
-// returns a new value for o.reuseConnection depending on the checks.
-func checkSSHDirectory(sshDirectory string, reuseConnection bool) bool {
-	if runtime.GOOS == "windows" {
-		flog.Info("OS is windows, disabling connection reuse feature")
-		return false
+// joinUser returns the ssh destination ip logged into as user, or as ssh's
+// default user if user is empty.
+func joinUser(user string, ip string) string {
+	if user == "" {
+		return ip
+	}
+	return user + "@" + ip
+}
+
+// splitHostPort splits a host of the form [user@]host[:port] into the ssh
+// destination [user@]host and the port, if any. IPv6 addresses with a port
+// must be in brackets, like [::1]:2222, which are removed.
+func splitHostPort(host string) (string, string, error) {
+	var user string
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i+1], host[i+1:]
 	}
 
-	sshDirectoryMode, err := os.Lstat(expandPath(sshDirectory))
-	if err != nil {
-		if reuseConnection {
-			flog.Info("failed to stat %v directory, disabling connection reuse feature: %v", sshDirectory, err)
+	var port string
+	switch {
+	case strings.HasPrefix(host, "["):
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return "", "", xerrors.Errorf("invalid host %q, missing ]", host)
 		}
-		reuseConnection = false
-	} else {
-		if !sshDirectoryMode.IsDir() {
-			if reuseConnection {
-				flog.Info("%v is not a directory, disabling connection reuse feature", sshDirectory)
-			} else {
-				flog.Info("warning: %v is not a directory", sshDirectory)
-			}
-			reuseConnection = false
+		rest := host[end+1:]
+		if rest != "" && !strings.HasPrefix(rest, ":") {
+			return "", "", xerrors.Errorf("invalid host %q, expected :port after ]", host)
 		}
-		if sshDirectoryMode.Mode().Perm()&sshDirectoryUnsafeModeMask != 0 {
-			flog.Info("warning: the %v directory has unsafe permissions, they should only be writable by "+
-				"the owner (and files inside should be set to 0600)", sshDirectory)
+		host, port = host[1:end], strings.TrimPrefix(rest, ":")
+	case strings.Count(host, ":") == 1:
+		i := strings.Index(host, ":")
+		host, port = host[:i], host[i+1:]
+	}
+	// More than one colon without brackets is an IPv6 address without a port.
+
+	if host == "" {
+		return "", "", xerrors.New("missing host")
+	}
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return "", "", xerrors.Errorf("invalid port %q, must be a number from 1 to 65535", port)
 		}
 	}
-	return reuseConnection
+	return user + host, port, nil
 }
 
-// startSSHMaster starts an SSH master connection and waits for it to be ready.
-// It returns a new set of SSH flags for child SSH processes to use.
-func startSSHMaster(sshFlags string, sshControlPath string, host string) (string, func(), error) {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	newSSHFlags := fmt.Sprintf(`%v -o "ControlPath=%v"`, sshFlags, sshControlPath)
-
-	// -MN means "start a master socket and don't open a session, just connect".
-	sshCmdStr := fmt.Sprintf(`exec ssh %v -MNq %v`, newSSHFlags, host)
-	sshMasterCmd := exec.CommandContext(ctx, "sh", "-c", sshCmdStr)
-	sshMasterCmd.Stdin = os.Stdin
-	sshMasterCmd.Stderr = os.Stderr
-
-	// Gracefully stop the SSH master.
-	stopSSHMaster := func() {
-		if sshMasterCmd.Process != nil {
-			if sshMasterCmd.ProcessState != nil && sshMasterCmd.ProcessState.Exited() {
-				return
-			}
-			err := sshMasterCmd.Process.Signal(syscall.SIGTERM)
-			if err != nil {
-				flog.Error("failed to send SIGTERM to SSH master process: %v", err)
-			}
+// jumpHopRegexp matches a single hop of a jump host, [user@]host[:port], where
+// host may be an IPv6 address in brackets.
+var jumpHopRegexp = regexp.MustCompile(`^([A-Za-z0-9_][A-Za-z0-9._-]*@)?([A-Za-z0-9][A-Za-z0-9._-]*|\[[0-9A-Fa-f:.]+\])(:[0-9]+)?$`)
+
+// validateJumpHost checks that jumpHost is a comma separated list of hops like
+// ssh's -J. As it ends up in the ssh flags unquoted, this also keeps it from
+// being interpreted by the shell.
+func validateJumpHost(jumpHost string) error {
+	for _, hop := range strings.Split(jumpHost, ",") {
+		if !jumpHopRegexp.MatchString(hop) {
+			return xerrors.Errorf("invalid jump host %q, expected comma separated hops of the form [user@]host[:port]", hop)
 		}
-		cancel()
 	}
+	return nil
+}
 
-	// Start ssh master and wait. Waiting prevents the process from becoming a zombie process if it dies before
-	// sshcode does, and allows sshMasterCmd.ProcessState to be populated.
-	err := sshMasterCmd.Start()
-	go sshMasterCmd.Wait()
-	if err != nil {
-		return "", stopSSHMaster, err
+// jumpHostFlags returns the SSH flags to connect through jumpHost, a comma
+// separated list of hops like ssh's -J. If identity is set, it's used for the
+// last hop, which needs a ProxyCommand as -J can't be given an identity.
+func jumpHostFlags(jumpHost string, identity string) string {
+	if identity == "" {
+		return "-J " + jumpHost
 	}
-	err = checkSSHMaster(sshMasterCmd, newSSHFlags, host)
-	if err != nil {
-		stopSSHMaster()
-		return "", stopSSHMaster, xerrors.Errorf("SSH master wasn't ready on time: %w", err)
+
+	hops := strings.Split(jumpHost, ",")
+	proxyCmd := fmt.Sprintf("ssh -i %v -W %%h:%%p", shellEscape(identity))
+	if len(hops) > 1 {
+		proxyCmd += " -J " + strings.Join(hops[:len(hops)-1], ",")
 	}
-	return newSSHFlags, stopSSHMaster, nil
-}
+	proxyCmd += " " + hops[len(hops)-1]
 
-// checkSSHMaster polls every second for 30 seconds to check if the SSH master
-// is ready.
-func checkSSHMaster(sshMasterCmd *exec.Cmd, sshFlags string, host string) error {
-	var (
-		maxTries = 30
-		sleepDur = time.Second
-		err      error
-	)
-	for i := 0; i < maxTries; i++ {
-		// Check if the master is running.
-		if sshMasterCmd.Process == nil || (sshMasterCmd.ProcessState != nil && sshMasterCmd.ProcessState.Exited()) {
-			return xerrors.Errorf("SSH master process is not running")
-		}
+	// Double quotes, as rsync's -e doesn't understand escaped single quotes.
+	// validateJumpIdentity keeps out what's special within them.
+	return fmt.Sprintf(`-o "ProxyCommand=%v"`, proxyCmd)
+}
 
-		// Check if it's ready.
-		sshCmdStr := fmt.Sprintf(`ssh %v -O check %v`, sshFlags, host)
-		sshCmd := exec.Command("sh", "-c", sshCmdStr)
-		err = sshCmd.Run()
-		if err == nil {
-			return nil
-		}
-		time.Sleep(sleepDur)
+// validateJumpIdentity checks that identity can be quoted in the ProxyCommand
+// of jumpHostFlags, which the shell reads within double quotes before ssh runs
+// it with the shell again.
+func validateJumpIdentity(identity string) error {
+	if strings.ContainsAny(identity, "\"$`\\\n") {
+		return xerrors.Errorf("invalid jump identity %q, it can't contain \", $, ` or \\, use / to separate directories", identity)
 	}
-	return xerrors.Errorf("max number of tries exceeded: %d", maxTries)
+	return nil
 }
 
-// copyCodeServerBinary copies a code-server binary from local to remote.
-func copyCodeServerBinary(sshFlags string, host string, localPath string, remotePath string) error {
-	if err := validateIsFile(localPath); err != nil {
-		return err
+// parseAWSSSHCmd resolves the EC2 instance given as [user@]ID-or-Name-tag to
+// its public IP, using the AWS CLI. Without a user, ssh's default is used.
+func parseAWSSSHCmd(instance string) (userIP, sshFlags string, err error) {
+	if err := checkCloudCLI("aws:"); err != nil {
+		return "", "", err
 	}
 
-	var (
-		src  = localPath
-		dest = host + ":" + remotePath
-	)
+	user, instance := splitUser(instance)
 
-	return rsync(src, dest, sshFlags)
-}
+	filter := "--filters " + shellEscape("Name=tag:Name,Values="+instance)
+	if strings.HasPrefix(instance, "i-") {
+		filter = "--instance-ids " + shellEscape(instance)
+	}
+	describeCmd := fmt.Sprintf("aws ec2 describe-instances %v "+
+		"--query 'Reservations[].Instances[?State.Name==`running`][].[PublicIpAddress,PrivateIpAddress]' --output text",
+		filter,
+	)
 
-func syncUserSettings(sshFlags string, host string, back bool) error {
-	localConfDir, err := configDir()
+	out, err := shellCommand(describeCmd).CombinedOutput()
 	if err != nil {
-		return err
+		return "", "", xerrors.Errorf("%s: %w", out, err)
 	}
 
-	err = ensureDir(localConfDir)
+	publicIP, privateIP, err := parseAWSInstanceIPs(string(out))
 	if err != nil {
-		return err
+		return "", "", xerrors.Errorf("failed to find running instance %q: %w", instance, err)
 	}
-
-	var remoteSettingsDir = "~/.local/share/code-server/User/"
-	if runtime.GOOS == "windows" {
-		remoteSettingsDir = ".local/share/code-server/User/"
+	if publicIP == "" {
+		return "", "", xerrors.Errorf("instance %q has no public IP, connect to its private IP %v through a bastion with --jump-host",
+			instance, privateIP,
+		)
 	}
-	var (
-		src  = localConfDir + "/"
-		dest = host + ":" + remoteSettingsDir
-	)
+	return joinUser(user, publicIP), "", nil
+}
 
-	if back {
-		dest, src = src, dest
+// parseAWSInstanceIPs parses the public and private IP of an instance from
+// describe-instances text output, where a missing IP is None.
+func parseAWSInstanceIPs(out string) (publicIP string, privateIP string, err error) {
+	var lines []string
+	if out = strings.TrimSpace(out); out != "" {
+		lines = strings.Split(out, "\n")
+	}
+	if len(lines) != 1 {
+		return "", "", xerrors.Errorf("expected one instance, found %v", len(lines))
 	}
 
-	// Append "/" to have rsync copy the contents of the dir.
-	return rsync(src, dest, sshFlags, "workspaceStorage", "logs", "CachedData")
+	ips := strings.Fields(lines[0])
+	if len(ips) != 2 {
+		return "", "", xerrors.Errorf("unexpected output %q", out)
+	}
+	for i, ip := range ips {
+		if ip == "None" {
+			ips[i] = ""
+		}
+	}
+	return ips[0], ips[1], nil
 }
 
-func syncExtensions(sshFlags string, host string, back bool) error {
-	localExtensionsDir, err := extensionsDir()
+// azureIPQuery is the JMESPath query selecting the resource group, public and
+// private IP of the VMs listed by az vm list-ip-addresses.
+const azureIPQuery = "[].virtualMachine.[resourceGroup, network.publicIpAddresses[0].ipAddress, network.privateIpAddresses[0]]"
+
+// parseAzureSSHCmd resolves the Azure VM given as [user@][resource-group/]name
+// to its public IP, using the Azure CLI. The user defaults to the VM's admin
+// user.
+func parseAzureSSHCmd(vm string) (userIP, sshFlags string, err error) {
+	if err := checkCloudCLI("azure:"); err != nil {
+		return "", "", err
+	}
+
+	user, vm := splitUser(vm)
+	var group, name string
+	if i := strings.Index(vm, "/"); i >= 0 {
+		group, name = vm[:i], vm[i+1:]
+	} else {
+		name = vm
+	}
+	if name == "" {
+		return "", "", xerrors.New("missing VM name, expected azure:[<user>@][<resource-group>/]<name>")
+	}
+
+	listCmd := fmt.Sprintf("az vm list-ip-addresses --name %v --query %v --output tsv", shellEscape(name), shellEscape(azureIPQuery))
+	if group != "" {
+		listCmd += " --resource-group " + shellEscape(group)
+	}
+	out, err := shellCommand(listCmd).CombinedOutput()
 	if err != nil {
-		return err
+		return "", "", azureCLIError(out, err)
 	}
 
-	err = ensureDir(localExtensionsDir)
+	group, publicIP, privateIP, err := parseAzureVMIPs(string(out))
 	if err != nil {
-		return err
+		return "", "", xerrors.Errorf("failed to find VM %q: %w", vm, err)
+	}
+	if publicIP == "" {
+		return "", "", xerrors.Errorf("VM %q has no public IP, connect to its private IP %v through a bastion with --jump-host",
+			vm, privateIP,
+		)
 	}
 
-	var remoteExtensionsDir = "~/.local/share/code-server/extensions/"
-	if runtime.GOOS == "windows" {
-		remoteExtensionsDir = ".local/share/code-server/extensions/"
+	if user != "" {
+		return joinUser(user, publicIP), "", nil
 	}
 
-	var (
-		src  = localExtensionsDir + "/"
-		dest = host + ":" + remoteExtensionsDir
+	showCmd := fmt.Sprintf("az vm show --resource-group %v --name %v --query osProfile.adminUsername --output tsv",
+		shellEscape(group), shellEscape(name),
 	)
-	if back {
-		dest, src = src, dest
+	out, err = shellCommand(showCmd).CombinedOutput()
+	if err != nil {
+		return "", "", azureCLIError(out, err)
 	}
-
-	return rsync(src, dest, sshFlags)
+	return joinUser(strings.TrimSpace(string(out)), publicIP), "", nil
 }
 
-func rsync(src string, dest string, sshFlags string, excludePaths ...string) error {
-	excludeFlags := make([]string, len(excludePaths))
-	for i, path := range excludePaths {
-		excludeFlags[i] = "--exclude=" + path
+// azureCLIError returns the error for a failed az command with output out,
+// pointing out when the Azure CLI needs to be logged in.
+func azureCLIError(out []byte, err error) error {
+	if bytes.Contains(out, []byte("az login")) {
+		return xerrors.Errorf("the Azure CLI isn't logged in, run az login first: %w", err)
 	}
+	return xerrors.Errorf("%s: %w", out, err)
+}
 
-	cmd := exec.Command("rsync", append(excludeFlags, "-azvr",
-		"-e", "ssh "+sshFlags,
-		// Only update newer directories, and sync times
-		// to keep things simple.
-		"-u", "--times",
-		// This is more unsafe, but it's obnoxious having to enter VS Code
-		// locally in order to properly delete an extension.
-		"--delete",
-		"--copy-unsafe-links",
-		"-zz",
-		src, dest,
-	)...,
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		return xerrors.Errorf("failed to rsync '%s' to '%s': %w", src, dest, err)
+// parseAzureVMIPs parses the resource group, public and private IP of a VM from
+// the tab separated output of az vm list-ip-addresses with azureIPQuery, where a
+// missing IP is empty or None.
+func parseAzureVMIPs(out string) (group string, publicIP string, privateIP string, err error) {
+	var lines []string
+	if out = strings.TrimSpace(out); out != "" {
+		lines = strings.Split(out, "\n")
+	}
+	if len(lines) == 0 {
+		return "", "", "", xerrors.New("no VM found")
+	}
+	if len(lines) > 1 {
+		groups := make([]string, len(lines))
+		for i, line := range lines {
+			groups[i] = strings.Split(line, "\t")[0]
+		}
+		return "", "", "", xerrors.Errorf("found VMs in resource groups %v, use azure:<resource-group>/<name>", strings.Join(groups, ", "))
 	}
 
-	return nil
+	fields := strings.Split(strings.TrimRight(lines[0], "\r"), "\t")
+	if len(fields) != 3 {
+		return "", "", "", xerrors.Errorf("unexpected output %q", out)
+	}
+	for i, field := range fields {
+		if field == "None" {
+			fields[i] = ""
+		}
+	}
+	return fields[0], fields[1], fields[2], nil
 }
 
-func downloadScript(codeServerPath string) string {
-	return fmt.Sprintf(
-		`set -euxo pipefail || exit 1
+// defaultDOUser is the user sshcode logs in to DigitalOcean droplets as, the
+// only one their stock images have.
+const defaultDOUser = "root"
 
-[ "$(uname -m)" != "x86_64" ] && echo "Unsupported server architecture $(uname -m). code-server only has releases for x86_64 systems." && exit 1
-pkill -f %v || true
-mkdir -p $HOME/.local/share/code-server %v
-cd %v
-curlflags="-o latest-linux"
-if [ -f latest-linux ]; then
-	curlflags="$curlflags -z latest-linux"
-fi
-curl $curlflags https://codesrv-ci.cdr.sh/latest-linux
-[ -f %v ] && rm %v
-ln latest-linux %v
-chmod +x %v`,
-		codeServerPath,
-		filepath.ToSlash(filepath.Dir(codeServerPath)),
-		filepath.ToSlash(filepath.Dir(codeServerPath)),
-		codeServerPath,
-		codeServerPath,
-		codeServerPath,
-		codeServerPath,
-	)
+// parseDOSSHCmd resolves the DigitalOcean droplet given as [user@]name-or-id to
+// its public IPv4, using doctl. The user defaults to defaultDOUser.
+func parseDOSSHCmd(droplet string) (userIP, sshFlags string, err error) {
+	if err := checkCloudCLI("do:"); err != nil {
+		return "", "", err
+	}
+
+	user, droplet := splitUser(droplet)
+	if user == "" {
+		user = defaultDOUser
+	}
+	if droplet == "" {
+		return "", "", xerrors.New("missing droplet, expected do:[<user>@]<name-or-id>")
+	}
+
+	listCmd := "doctl compute droplet list --format ID,Name,PublicIPv4 --no-header"
+	out, err := shellCommand(listCmd).CombinedOutput()
+	if err != nil {
+		return "", "", xerrors.Errorf("%s: %w", out, err)
+	}
+
+	ip, err := parseDODropletIP(string(out), droplet)
+	if err != nil {
+		return "", "", err
+	}
+	return joinUser(user, ip), "", nil
 }
 
-// ensureDir creates a directory if it does not exist.
-func ensureDir(path string) error {
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		// This fixes a issue where Go reads `/c/` as `C:\c\` and creates
-		// empty directories on the client that don't need to exist.
-		if runtime.GOOS == "windows" && strings.HasPrefix(path, "/c/") {
-			path = "C:" + path[2:]
+// parseDODropletIP returns the public IPv4 of the droplet with the name or ID
+// nameOrID from the output of doctl compute droplet list with the ID, Name and
+// PublicIPv4 columns and no header.
+func parseDODropletIP(out string, nameOrID string) (string, error) {
+	var (
+		ids []string
+		ip  string
+	)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != nameOrID && fields[1] != nameOrID) {
+			continue
+		}
+		ids = append(ids, fields[0])
+		ip = ""
+		if len(fields) > 2 {
+			ip = fields[2]
 		}
-		err = os.MkdirAll(path, 0750)
 	}
 
-	if err != nil {
-		return err
+	switch {
+	case len(ids) == 0:
+		return "", xerrors.Errorf("no droplet named %q or with that ID", nameOrID)
+	case len(ids) > 1:
+		return "", xerrors.Errorf("several droplets are named %q, use one of their IDs instead: %v", nameOrID, strings.Join(ids, ", "))
+	case ip == "":
+		return "", xerrors.Errorf("droplet %q has no public IPv4, connect to it through a bastion with --jump-host", nameOrID)
 	}
+	return ip, nil
+}
 
-	return nil
+// sshHostConfig is the configuration ssh connects to a host with.
+type sshHostConfig struct {
+	user     string
+	hostname string
+	port     string
 }
 
-// validateIsFile tries to stat the specified path and ensure it's a file.
-func validateIsFile(path string) error {
-	info, err := os.Stat(path)
+// resolveSSHHost returns the configuration ssh connects to host with, taking
+// aliases and other settings from the ssh config into account.
+func resolveSSHHost(host string, sshFlags string) (sshHostConfig, error) {
+	sshCmdStr := fmt.Sprintf("%v -G %v", sshCommand(sshFlags), host)
+	out, err := shellCommand(sshCmdStr).Output()
 	if err != nil {
-		return err
-	}
-	if info.IsDir() {
-		return xerrors.New("path is a directory")
+		return sshHostConfig{}, xerrors.Errorf("%s: %w", sshCmdStr, err)
 	}
-	return nil
+	return parseSSHConfig(string(out)), nil
 }
 
-// parseHost parses the host argument. If 'gcp:' is prefixed to the
-// host then a lookup is done using gcloud to determine the external IP and any
-// additional SSH arguments that should be used for ssh commands. Otherwise, host
-// is returned.
-func parseHost(host string) (parsedHost string, additionalFlags string, err error) {
-	host = strings.TrimSpace(host)
-	switch {
-	case strings.HasPrefix(host, "gcp:"):
-		instance := strings.TrimPrefix(host, "gcp:")
-		return parseGCPSSHCmd(instance)
-	default:
-		return host, "", nil
+// parseSSHConfig parses the output of ssh -G, one lowercase option and its
+// value per line.
+func parseSSHConfig(out string) sshHostConfig {
+	var config sshHostConfig
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "user":
+			config.user = fields[1]
+		case "hostname":
+			config.hostname = fields[1]
+		case "port":
+			config.port = fields[1]
+		}
 	}
+	return config
 }
 
 // parseGCPSSHCmd parses the IP address and flags used by 'gcloud' when
 // ssh'ing to an instance.
 func parseGCPSSHCmd(instance string) (ip, sshFlags string, err error) {
+	if err := checkCloudCLI("gcp:"); err != nil {
+		return "", "", err
+	}
+
 	dryRunCmd := fmt.Sprintf("gcloud compute ssh --dry-run %v", instance)
 
-	out, err := exec.Command("sh", "-l", "-c", dryRunCmd).CombinedOutput()
+	out, err := shellCommand(dryRunCmd).CombinedOutput()
 	if err != nil {
 		return "", "", xerrors.Errorf("%s: %w", out, err)
 	}
@@ -1,21 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.coder.com/retry"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
 )
 
 func TestSSHCode(t *testing.T) {
@@ -48,10 +57,10 @@ func TestSSHCode(t *testing.T) {
 	waitForSSHCode(t, remotePort, time.Second*30)
 
 	// Typically we'd do an os.Stat call here but the os package doesn't expand '~'
-	out, err := exec.Command("sh", "-l", "-c", "stat "+codeServerPath).CombinedOutput()
+	out, err := exec.Command("sh", "-l", "-c", "stat "+codeServerPath(options{})).CombinedOutput()
 	require.NoError(t, err, "%s", out)
 
-	out, err = exec.Command("pkill", filepath.Base(codeServerPath)).CombinedOutput()
+	out, err = exec.Command("pkill", codeServerName).CombinedOutput()
 	require.NoError(t, err, "%s", out)
 
 	wg.Wait()
@@ -314,3 +323,1783 @@ func randomPortExclude(t *testing.T, exludedPorts ...string) string {
 
 	return ""
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{in: "512", want: 512},
+		{in: "100K", want: 100 << 10},
+		{in: "1.5G", want: 3 << 29},
+		{in: "2gb", want: 2 << 30},
+		{in: "10MiB", want: 10 << 20},
+		{in: "", err: true},
+		{in: "G", err: true},
+		{in: "-1M", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if tt.err {
+			require.Error(t, err, tt.in)
+			continue
+		}
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestScanListeningPort(t *testing.T) {
+	const out = `INFO  Starting webserver... {"host":"127.0.0.1","port":0}
+INFO  Server listening on http://127.0.0.1:41379
+INFO  Connected to shared process
+`
+	port, ok := <-scanListeningPort(strings.NewReader(out), ioutil.Discard)
+	require.True(t, ok)
+	require.Equal(t, "41379", port)
+
+	_, ok = <-scanListeningPort(strings.NewReader("INFO  Starting webserver...\n"), ioutil.Discard)
+	require.False(t, ok)
+}
+
+func TestShellEscape(t *testing.T) {
+	for _, s := range []string{"", "plain", "with space", "it's", `"$HOME"`, "a\nb"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellEscape(s)).Output()
+		require.NoError(t, err)
+		require.Equal(t, s, string(out))
+	}
+}
+
+func TestJumpHostFlags(t *testing.T) {
+	require.Equal(t, "-J bastion", jumpHostFlags("bastion", ""))
+	require.Equal(t, "-J a,user@b:2222", jumpHostFlags("a,user@b:2222", ""))
+	require.Equal(t,
+		`-o "ProxyCommand=ssh -i '~/.ssh/bastion' -W %h:%p user@bastion"`,
+		jumpHostFlags("user@bastion", "~/.ssh/bastion"),
+	)
+	require.Equal(t,
+		`-o "ProxyCommand=ssh -i 'key' -W %h:%p -J a,b c"`,
+		jumpHostFlags("a,b,c", "key"),
+	)
+	require.Equal(t,
+		`-o "ProxyCommand=ssh -i '~/.ssh/kyle'\''s key' -W %h:%p bastion"`,
+		jumpHostFlags("bastion", "~/.ssh/kyle's key"),
+	)
+
+	for _, identity := range []string{`key"; touch pwned; "`, "$(touch pwned)", "`touch pwned`", `C:\keys\bastion`} {
+		_, err := buildSSHFlags("", options{jumpHost: "bastion", jumpIdentity: identity})
+		require.Error(t, err, identity)
+	}
+
+	if !commandExists("sh") {
+		return
+	}
+	// The flags are read by the shell, and the ProxyCommand by the shell
+	// again, which must leave the identity as a single argument.
+	flags := jumpHostFlags("bastion", "~/.ssh/kyle's key")
+	out, err := exec.Command("sh", "-c", "printf %s "+flags).Output()
+	require.NoError(t, err)
+	proxyCmd := strings.TrimPrefix(string(out[len("-o"):]), "ProxyCommand=")
+	require.True(t, strings.HasPrefix(proxyCmd, "ssh "), proxyCmd)
+	out, err = exec.Command("sh", "-c", `printf '%s\n' `+strings.TrimPrefix(proxyCmd, "ssh ")).Output()
+	require.NoError(t, err)
+	require.Equal(t, "-i\n~/.ssh/kyle's key\n-W\n%h:%p\nbastion\n", string(out))
+}
+
+func TestValidateJumpHost(t *testing.T) {
+	for _, jumpHost := range []string{"bastion", "user@bastion.example.com:2222", "a,user@b:2222,c", "user@[fe80::1]:22"} {
+		require.NoError(t, validateJumpHost(jumpHost), jumpHost)
+	}
+	for _, jumpHost := range []string{"", "a,,b", "a b", "bastion;reboot", "user@", "bastion:ssh", "-oProxyCommand=x", "-oFoo"} {
+		require.Error(t, validateJumpHost(jumpHost), jumpHost)
+	}
+}
+
+func TestPassthroughEnv(t *testing.T) {
+	os.Setenv("SSHCODE_TEST_TOKEN", "it's secret")
+	defer os.Unsetenv("SSHCODE_TEST_TOKEN")
+	os.Unsetenv("SSHCODE_TEST_UNSET")
+
+	names := []string{"SSHCODE_TEST_TOKEN", "SSHCODE_TEST_UNSET"}
+	env := passthroughEnv(names)
+	require.Equal(t, []string{`SSHCODE_TEST_TOKEN='it'\''s secret'`}, env)
+
+	cmd := codeServerCommand("~", options{remotePort: "8443", envPassthrough: names})
+	require.True(t, strings.HasPrefix(cmd, "env "+env[0]+" "), cmd)
+	require.NotContains(t, redactEnv(cmd, options{envPassthrough: names}), "secret")
+	require.NotContains(t, redactEnv("ssh host "+shellEscape(cmd), options{envPassthrough: names}), "secret")
+
+	o := options{remotePort: "8443", remoteAccessible: true, password: "hunter2"}
+	cmd = codeServerCommand("~", o)
+	require.Contains(t, cmd, "PASSWORD='hunter2'")
+	require.Contains(t, cmd, "--host 0.0.0.0 --auth password")
+	require.NotContains(t, redactEnv(cmd, o), "hunter2")
+
+	o = options{remotePort: "8443", auth: true, password: "hunter2"}
+	cmd = codeServerCommand("~", o)
+	require.Contains(t, cmd, "--host 127.0.0.1 --auth password")
+}
+
+func TestCodeServerCommand(t *testing.T) {
+	server := codeServerPath(options{})
+	tests := []struct {
+		name string
+		o    options
+		want string
+	}{
+		{"default", options{}, server + " ~ --host 127.0.0.1 --auth none --port=8443"},
+		// code-server generates a self-signed certificate.
+		{"tls", options{tls: true}, server + " ~ --host 127.0.0.1 --auth none --port=8443 --cert"},
+		// The password is passed in the environment, not on the command line.
+		{"password", options{password: "hunter2"}, "env PASSWORD='hunter2' " + server + " ~ --host 127.0.0.1 --auth password --port=8443"},
+		{
+			"remote accessible over tls", options{remoteAccessible: true, password: "hunter2", tls: true},
+			"env PASSWORD='hunter2' " + server + " ~ --host 0.0.0.0 --auth password --port=8443 --cert",
+		},
+	}
+	for _, tt := range tests {
+		tt.o.remotePort = "8443"
+		require.Equal(t, tt.want, codeServerCommand("~", tt.o), tt.name)
+	}
+}
+
+func TestCodeServerFlags(t *testing.T) {
+	flags := `--disable-telemetry --user-data-dir "$HOME/my data" --extensions-dir '/opt/ext'`
+	cmd := codeServerCommand("~", options{remotePort: "8443", codeServerFlags: flags})
+	require.True(t, strings.HasSuffix(cmd, " --port=8443 "+flags), cmd)
+
+	// The command is quoted once more for ssh, which must leave the flags
+	// intact for the remote shell.
+	out, err := exec.Command("sh", "-c", "printf %s "+shellEscape(cmd)).Output()
+	require.NoError(t, err)
+	require.Equal(t, cmd, string(out))
+}
+
+func TestParseIoniceClass(t *testing.T) {
+	tests := []struct {
+		class   string
+		want    string
+		wantErr bool
+	}{
+		{"realtime", "1", false},
+		{"best-effort", "2", false},
+		{"idle", "3", false},
+		{"3", "3", false},
+		{"0", "", true},
+		{"Idle", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseIoniceClass(tt.class)
+		if tt.wantErr {
+			require.Error(t, err, tt.class)
+			continue
+		}
+		require.NoError(t, err, tt.class)
+		require.Equal(t, tt.want, got, tt.class)
+	}
+}
+
+func TestCodeServerCommandPriority(t *testing.T) {
+	server := codeServerCommand("~", options{remotePort: "8443"})
+	tests := []struct {
+		name string
+		o    options
+		want string
+	}{
+		{"default", options{}, server},
+		{"nice", options{remoteNice: 10}, "nice -n 10 " + server},
+		{"negative nice", options{remoteNice: -5}, "nice -n -5 " + server},
+		{"ionice", options{remoteIonice: "3"}, "ionice -c 3 " + server},
+		// nice applies to ionice and so to code-server.
+		{"both", options{remoteNice: 19, remoteIonice: "2"}, "nice -n 19 ionice -c 2 " + server},
+	}
+	for _, tt := range tests {
+		tt.o.remotePort = "8443"
+		require.Equal(t, tt.want, codeServerCommand("~", tt.o), tt.name)
+	}
+
+	// The environment is set for the whole command.
+	old, ok := os.LookupEnv("SSHCODE_TEST_VAR")
+	require.NoError(t, os.Setenv("SSHCODE_TEST_VAR", "1"))
+	if ok {
+		defer os.Setenv("SSHCODE_TEST_VAR", old)
+	} else {
+		defer os.Unsetenv("SSHCODE_TEST_VAR")
+	}
+	cmd := codeServerCommand("~", options{remotePort: "8443", remoteNice: 10, envPassthrough: []string{"SSHCODE_TEST_VAR"}})
+	require.True(t, strings.HasPrefix(cmd, "env "), cmd)
+	require.True(t, strings.HasSuffix(cmd, " nice -n 10 "+server), cmd)
+}
+
+func TestSessionName(t *testing.T) {
+	o := options{remotePort: "8443"}
+	require.NotContains(t, codeServerCommand("~", o), "--user-data-dir")
+	require.Equal(t, "~/.local/share/code-server/User/", remoteDataPath("User/", o))
+	require.Equal(t, "~/.cache/sshcode/sshcode-server.log", codeServerLogPath(o))
+
+	o.sessionName = "api"
+	require.True(t, strings.HasSuffix(codeServerCommand("~", o),
+		" --user-data-dir ~/.local/share/code-server-api --extensions-dir ~/.local/share/code-server-api/extensions"),
+	)
+	require.Equal(t, "~/.local/share/code-server-api/User/", remoteDataPath("User/", o))
+	require.Equal(t, "~/.local/share/code-server-api/extensions/", remoteDataPath("extensions/", o))
+	require.Equal(t, "~/.cache/sshcode/sshcode-server-api.log", codeServerLogPath(o))
+
+	o.sessionName = ""
+	o.userDataDir = "projects/api/.code-server"
+	require.True(t, strings.HasSuffix(codeServerCommand("~", o),
+		" --user-data-dir ~/projects/api/.code-server --extensions-dir ~/projects/api/.code-server/extensions"),
+	)
+	require.Equal(t, "~/projects/api/.code-server/User/", remoteDataPath("User/", o))
+	require.Contains(t, downloadScript(codeServerPath(o), remoteDataDir(o), "", nil, "", false),
+		`mkdir -p "$HOME"/'projects/api/.code-server' `,
+	)
+
+	o.userDataDir = "/srv/code-server"
+	require.True(t, strings.HasSuffix(codeServerCommand("~", o),
+		" --user-data-dir /srv/code-server --extensions-dir /srv/code-server/extensions"),
+	)
+	require.Equal(t, "/srv/code-server/extensions/", remoteDataPath("extensions/", o))
+	require.Contains(t, downloadScript(codeServerPath(o), remoteDataDir(o), "", nil, "", false),
+		"mkdir -p '/srv/code-server' ",
+	)
+
+	tests := []struct {
+		dir     string
+		want    string
+		wantErr bool
+	}{
+		{"~/projects/api/", "projects/api", false},
+		{".vscode-remote", ".vscode-remote", false},
+		{"/srv/code-server", "/srv/code-server", false},
+		{"~", "", true},
+		{"~/", "", true},
+		{"~other/data", "", true},
+		{"my data", "", true},
+		{"$HOME/data", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseUserDataDir(tt.dir)
+		if tt.wantErr {
+			require.Error(t, err, tt.dir)
+			continue
+		}
+		require.NoError(t, err, tt.dir)
+		require.Equal(t, tt.want, got, tt.dir)
+	}
+
+	require.True(t, sessionNameRegexp.MatchString("web-2.0"))
+	require.False(t, sessionNameRegexp.MatchString("../other"))
+	require.False(t, sessionNameRegexp.MatchString("my session"))
+}
+
+func TestRsyncVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		out  string
+		want bool
+	}{
+		{"rsync  version 3.2.7  protocol version 31\n", true},
+		{"rsync  version 3.1.0  protocol version 31\n", true},
+		{"rsync  version 2.6.9  protocol version 29\n", false},
+		{"openrsync: protocol version 29\nrsync version 2.6.9 compatible\n", false},
+		{"rsync  version 4.0.0  protocol version 32\n", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, rsyncVersionAtLeast(tt.out, 3, 1), tt.out)
+	}
+}
+
+func TestDownloadURLs(t *testing.T) {
+	require.Equal(t, []string{defaultDownloadURL}, downloadURLs("", ""))
+	require.Equal(t,
+		[]string{"https://a.example/cs", "https://b.example/cs", defaultDownloadURL},
+		downloadURLs("https://a.example/cs, https://b.example/cs,", ""),
+	)
+	require.Equal(t,
+		[]string{defaultDownloadURL, "https://a.example/cs"},
+		downloadURLs(defaultDownloadURL+",https://a.example/cs", ""),
+	)
+	require.Equal(t,
+		[]string{"https://a.example/cs/v2.1692-vsc1.39.2-linux", downloadBaseURL + "v2.1692-vsc1.39.2-linux"},
+		downloadURLs("https://a.example/cs", "2.1692-vsc1.39.2"),
+	)
+	require.Equal(t,
+		[]string{"https://a.example/cs/v2.1-linux", downloadBaseURL + "v2.1-linux"},
+		downloadURLs("https://a.example/cs/, "+downloadBaseURL, "v2.1"),
+	)
+}
+
+func TestNewDownloadPaths(t *testing.T) {
+	tests := []struct {
+		codeServerPath string
+		want           downloadPaths
+	}{
+		{"~/.cache/sshcode/sshcode-server", downloadPaths{
+			binary:      "~/.cache/sshcode/sshcode-server",
+			dir:         "~/.cache/sshcode",
+			versionFile: "~/.cache/sshcode/sshcode-server.version",
+		}},
+		{"/opt/sshcode/sshcode-server", downloadPaths{
+			binary:      "/opt/sshcode/sshcode-server",
+			dir:         "/opt/sshcode",
+			versionFile: "/opt/sshcode/sshcode-server.version",
+		}},
+		{"sshcode-server", downloadPaths{
+			binary:      "sshcode-server",
+			dir:         ".",
+			versionFile: "sshcode-server.version",
+		}},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, newDownloadPaths(tt.codeServerPath), tt.codeServerPath)
+	}
+}
+
+func TestDownloadScript(t *testing.T) {
+	for _, verifyChecksum := range []bool{false, true} {
+		script := downloadScript("~/.cache/sshcode/sshcode-server", ".local/share/code-server-work", "8443",
+			[]string{"https://a.example/cs", downloadBaseURL + "v2.1-linux"}, "2.1", verifyChecksum,
+		)
+		require.Contains(t, script, `mkdir -p "$HOME"/'.local/share/code-server-work' ~/.cache/sshcode`+"\n")
+		require.Contains(t, script, "cd ~/.cache/sshcode\n")
+		require.Contains(t, script, `ln "$file" ~/.cache/sshcode/sshcode-server`+"\n")
+		require.Contains(t, script, `[ "$(cat ~/.cache/sshcode/sshcode-server.version 2>/dev/null)" = "$version" ]`)
+		require.Contains(t, script, `echo "$version" > ~/.cache/sshcode/sshcode-server.version`+"\n")
+		require.Contains(t, script, "version='2.1'\n")
+		require.Contains(t, script, "file='v2.1-linux'\"$arch_suffix\"\n")
+		require.Contains(t, script, "for mirror in 'https://a.example/cs' '"+downloadBaseURL+"v2.1-linux'; do")
+		require.Contains(t, script, killCodeServerCmd("8443"))
+		// Leftover or missing fmt arguments.
+		require.NotContains(t, script, "%!")
+		require.NotContains(t, script, "%v")
+		require.Equal(t, verifyChecksum, strings.Contains(script, "sha256sum"))
+		// Missing checksums aren't reported as failed verifications.
+		require.Equal(t, verifyChecksum, strings.Contains(script, fmt.Sprintf("\texit %v\n", checksumMissingExitCode)))
+		require.Equal(t, verifyChecksum, strings.Contains(script, fmt.Sprintf("\texit %v\n", checksumFailedExitCode)))
+	}
+}
+
+func TestHostKeyCheckingFlags(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{"yes", "-o StrictHostKeyChecking=yes", false},
+		{"accept-new", "-o StrictHostKeyChecking=accept-new", false},
+		{"no", "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null", false},
+		{"maybe", "", true},
+	}
+	for _, tt := range tests {
+		got, err := hostKeyCheckingFlags(tt.policy)
+		if tt.wantErr {
+			require.Error(t, err, tt.policy)
+			continue
+		}
+		require.NoError(t, err, tt.policy)
+		require.Equal(t, tt.want, got, tt.policy)
+	}
+}
+
+func TestParseRemoteDir(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"~", "~"},
+		{"~/projects", "~/'projects'"},
+		{"~/my projects", "~/'my projects'"},
+		{"~kyle/src", "~kyle/'src'"},
+		{"/srv/app", "'/srv/app'"},
+		{"/srv/my app", "'/srv/my app'"},
+		{"$HOME/work", `"$HOME"/'work'`},
+		{"~/", "~/"},
+		{"${HOME}", `"${HOME}"`},
+		{"~ old", "'~ old'"},
+		{"it's; rm -rf ~", `'it'\''s; rm -rf ~'`},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, parseRemoteDir(tt.in), tt.in)
+	}
+
+	// The quoted directory must come out of the shell as a single, expanded
+	// argument.
+	home := os.Getenv("HOME")
+	for in, want := range map[string]string{
+		"~/my projects": home + "/my projects",
+		"$HOME/a b":     home + "/a b",
+		"/srv/app":      "/srv/app",
+	} {
+		out, err := exec.Command("sh", "-c", "printf %s "+parseRemoteDir(in)).Output()
+		require.NoError(t, err)
+		require.Equal(t, want, string(out), in)
+	}
+}
+
+func TestParseSSHConfig(t *testing.T) {
+	const out = `host dev
+user kyle
+hostname dev.kwc.io
+port 2222
+identityfile ~/.ssh/id_ed25519
+proxyjump bastion
+`
+	require.Equal(t,
+		sshHostConfig{user: "kyle", hostname: "dev.kwc.io", port: "2222"},
+		parseSSHConfig(out),
+	)
+}
+
+func TestParseAWSInstanceIPs(t *testing.T) {
+	public, private, err := parseAWSInstanceIPs("3.120.1.2\t10.0.1.5\n")
+	require.NoError(t, err)
+	require.Equal(t, "3.120.1.2", public)
+	require.Equal(t, "10.0.1.5", private)
+
+	public, private, err = parseAWSInstanceIPs("None\t10.0.1.5\n")
+	require.NoError(t, err)
+	require.Equal(t, "", public)
+	require.Equal(t, "10.0.1.5", private)
+
+	_, _, err = parseAWSInstanceIPs("")
+	require.Error(t, err)
+
+	_, _, err = parseAWSInstanceIPs("3.120.1.2\t10.0.1.5\n3.120.1.3\t10.0.1.6\n")
+	require.Error(t, err)
+}
+
+func TestParseAzureVMIPs(t *testing.T) {
+	group, public, private, err := parseAzureVMIPs("dev\t20.50.1.2\t10.0.0.4\n")
+	require.NoError(t, err)
+	require.Equal(t, "dev", group)
+	require.Equal(t, "20.50.1.2", public)
+	require.Equal(t, "10.0.0.4", private)
+
+	_, public, private, err = parseAzureVMIPs("dev\t\t10.0.0.4\n")
+	require.NoError(t, err)
+	require.Equal(t, "", public)
+	require.Equal(t, "10.0.0.4", private)
+
+	_, _, _, err = parseAzureVMIPs("")
+	require.Error(t, err)
+
+	_, _, _, err = parseAzureVMIPs("dev\t20.50.1.2\t10.0.0.4\nprod\t20.50.1.3\t10.0.0.5\n")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dev, prod")
+}
+
+func TestWriteSessionStatus(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeSessionStatus(&buf, sessionStatus{
+		URL:        "http://127.0.0.1:8443",
+		Host:       "kyle@dev.kwc.io",
+		BindAddr:   "127.0.0.1:8443",
+		LocalPort:  "8443",
+		RemotePort: "9000",
+		PID:        1234,
+	})
+	require.NoError(t, err)
+	require.Equal(t,
+		`{"url":"http://127.0.0.1:8443","host":"kyle@dev.kwc.io","bindAddr":"127.0.0.1:8443","localPort":"8443","remotePort":"9000","pid":1234}`+"\n",
+		buf.String(),
+	)
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	require.NoError(t, runWithTimeout(exec.Command("true"), time.Second, options{}))
+	require.NoError(t, runWithTimeout(exec.Command("true"), 0, options{}))
+
+	start := time.Now()
+	err := runWithTimeout(exec.Command("sleep", "10"), 100*time.Millisecond, options{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sleep didn't finish within 100ms")
+	require.True(t, time.Since(start) < 5*time.Second, "sleep must be stopped")
+}
+
+func TestBuildSSHFlags(t *testing.T) {
+	flags, err := buildSSHFlags("", options{})
+	require.NoError(t, err)
+	require.Equal(t, "", flags)
+	require.Equal(t, "ssh dev.kwc.io 'test -x ~/bin'", remoteCommand(flags, "dev.kwc.io", "test -x ~/bin"))
+
+	hostKeyFlags, err := hostKeyCheckingFlags("accept-new")
+	require.NoError(t, err)
+	flags, err = buildSSHFlags("-p 2222", options{
+		sshFlags:        "-i ~/.ssh/dev",
+		jumpHost:        "bastion",
+		hostKeyChecking: "accept-new",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "-p 2222 "+hostKeyFlags+" "+jumpHostFlags("bastion", "")+" -i ~/.ssh/dev", flags)
+	// rsync's remote shell and the ssh commands connect the same way.
+	require.True(t, strings.HasPrefix(remoteCommand(flags, "dev.kwc.io", "true"), sshCommand(flags)+" dev.kwc.io "))
+
+	flags, err = buildSSHFlags("-p 2222", options{sshFlags: "-i ~/.ssh/dev", agentForward: true})
+	require.NoError(t, err)
+	require.Equal(t, "-p 2222 -A -i ~/.ssh/dev", flags)
+
+	_, err = buildSSHFlags("", options{jumpIdentity: "~/.ssh/bastion"})
+	require.Error(t, err)
+	flags, err = buildSSHFlags("", options{hostKeyChecking: "accept-new", knownHosts: "~/.ssh/cloud_hosts"})
+	require.NoError(t, err)
+	require.Equal(t, hostKeyFlags+" -o UserKnownHostsFile='~/.ssh/cloud_hosts'", flags)
+
+	_, err = buildSSHFlags("", options{hostKeyChecking: "maybe"})
+	require.Error(t, err)
+	_, err = buildSSHFlags("", options{hostKeyChecking: "no", knownHosts: "~/.ssh/cloud_hosts"})
+	require.Error(t, err)
+}
+
+func TestTunnelCommand(t *testing.T) {
+	require.Equal(t,
+		"ssh -tt -q -L '127.0.0.1:8443:localhost:9000' -p 2222 dev.kwc.io 'cat > /dev/null'",
+		tunnelCommand("", "-L '127.0.0.1:8443:localhost:9000'", "-p 2222", "dev.kwc.io", "cat > /dev/null"),
+	)
+	require.Equal(t,
+		"autossh -M 0 -tt -q -L '127.0.0.1:8443:localhost:9000' -p 2222 dev.kwc.io 'cat > /dev/null'",
+		tunnelCommand("autossh -M 0", "-L '127.0.0.1:8443:localhost:9000'", "-p 2222", "dev.kwc.io", "cat > /dev/null"),
+	)
+}
+
+func TestMatchExtensionDir(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{"ms-python.python-2019.8.30787", "ms-python.python", true},
+		{"ms-python.python-2019.8.30787", "MS-Python.Python", true},
+		{"ms-python.python", "ms-python.python", true},
+		{"golang.go-0.14.1-linux-x64", "golang.go", true},
+		{"ms-python.python-insiders-1.0.0", "ms-python.python", false},
+		{"ms-python.python-", "ms-python.python", false},
+		{"ms-python.pythonic-1.0.0", "ms-python.python", false},
+		{"golang.go-0.14.1", "ms-python.python", false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, matchExtensionDir(tt.name, tt.id), tt.name+" "+tt.id)
+	}
+}
+
+func TestCheckExtensionsSyncSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-extensions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, size := range map[string]int{
+		"ms-python.python-2019.8.30787": 100,
+		"golang.go-0.14.1":              1000,
+	} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name, "extension.js"), make([]byte, size), 0644))
+	}
+
+	require.NoError(t, checkExtensionsSyncSize(dir, []string{"ms-python.python"}, 500), "only the selected extensions count")
+	require.Error(t, checkExtensionsSyncSize(dir, []string{"ms-python.python", "golang.go"}, 500))
+	require.NoError(t, checkExtensionsSyncSize(dir, []string{"ms-python.python", "golang.go"}, 0), "no limit")
+}
+
+func TestExtensionFilterFlags(t *testing.T) {
+	if !commandExists("rsync") {
+		t.Skip("rsync is not installed")
+	}
+
+	local, err := ioutil.TempDir("", "sshcode-local")
+	require.NoError(t, err)
+	defer os.RemoveAll(local)
+	remote, err := ioutil.TempDir("", "sshcode-remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(remote)
+
+	write := func(path string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+		require.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0640))
+	}
+	write(filepath.Join(local, "ms-python.python-2019.9.0", "package.json"))
+	write(filepath.Join(local, "golang.go-0.14.1", "package.json"))
+	write(filepath.Join(remote, "ms-python.python-2019.8.0", "package.json"))
+	write(filepath.Join(remote, "eamodio.gitlens-10.0.0", "package.json"))
+
+	err = runRsync(local+"/", remote+"/", options{}, extensionFilterFlags([]string{"ms-python.python"}))
+	require.NoError(t, err)
+	require.True(t, pathExists(filepath.Join(remote, "ms-python.python-2019.9.0", "package.json")))
+	require.False(t, pathExists(filepath.Join(remote, "ms-python.python-2019.8.0")), "old versions are deleted")
+	require.False(t, pathExists(filepath.Join(remote, "golang.go-0.14.1")), "only the given extensions are synced")
+	require.True(t, pathExists(filepath.Join(remote, "eamodio.gitlens-10.0.0")), "other extensions are left alone")
+}
+
+func TestNotifyInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals can't be sent on Windows")
+	}
+
+	interrupt, stop := notifyInterrupt()
+	defer stop()
+
+	self, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	for _, sig := range []os.Signal{os.Interrupt, syscall.SIGTERM} {
+		require.NoError(t, self.Signal(sig))
+		// Nothing receives for a while, as when the signal arrives during
+		// startup.
+		time.Sleep(100 * time.Millisecond)
+
+		select {
+		case got := <-interrupt:
+			require.Equal(t, sig, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v wasn't received", sig)
+		}
+	}
+}
+
+func TestWindowsToastScript(t *testing.T) {
+	tests := []struct {
+		title string
+		msg   string
+		want  []string
+	}{
+		{
+			"sshcode", "code-server is ready",
+			[]string{"CreateTextNode('sshcode')", "CreateTextNode('code-server is ready')"},
+		},
+		{
+			"sshcode", "kyle's session ended",
+			[]string{"CreateTextNode('kyle''s session ended')"},
+		},
+		{
+			"it's $env:USERNAME", `"quoted" $(whoami)`,
+			[]string{"CreateTextNode('it''s $env:USERNAME')", `CreateTextNode('"quoted" $(whoami)')`},
+		},
+	}
+	for _, tt := range tests {
+		script := windowsToastScript(tt.title, tt.msg)
+		for _, want := range tt.want {
+			require.Contains(t, script, want, tt.msg)
+		}
+		require.NotContains(t, script, "%!", tt.msg)
+	}
+}
+
+func TestReadyMessage(t *testing.T) {
+	require.Equal(t, "\nOpen this in your browser: http://127.0.0.1:8443\n\n", readyMessage("http://127.0.0.1:8443", ""))
+	require.Equal(t,
+		"\nOpen this in your browser: http://127.0.0.1:8443\nLog in with password: hunter2\n\n",
+		readyMessage("http://127.0.0.1:8443", "hunter2"),
+	)
+}
+
+func TestParseDODropletIP(t *testing.T) {
+	const out = `123    web         203.0.113.10
+456    db          203.0.113.11
+789    web         203.0.113.12
+1011   private
+`
+	ip, err := parseDODropletIP(out, "db")
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.11", ip)
+
+	ip, err = parseDODropletIP(out, "789")
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.12", ip)
+
+	_, err = parseDODropletIP(out, "web")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "123, 789")
+
+	_, err = parseDODropletIP(out, "private")
+	require.Error(t, err)
+	_, err = parseDODropletIP(out, "nope")
+	require.Error(t, err)
+}
+
+func TestRsyncFlags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake rsync is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "sshcode-rsync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The fake rsync records its arguments, one per line.
+	argsPath := filepath.Join(dir, "args")
+	script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$@\" > %v\n", shellEscape(argsPath))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rsync"), []byte(script), 0755))
+	path := os.Getenv("PATH")
+	require.NoError(t, os.Setenv("PATH", dir+string(os.PathListSeparator)+path))
+	defer os.Setenv("PATH", path)
+
+	err = runRsync("src/", "host:dest/", options{rsyncFlags: `--bwlimit=1000 --chmod="D755,F644"`}, []string{"-u"})
+	require.NoError(t, err)
+	out, err := ioutil.ReadFile(argsPath)
+	require.NoError(t, err)
+	args := strings.Split(strings.TrimSpace(string(out)), "\n")
+	require.Contains(t, args, "--bwlimit=1000")
+	require.Contains(t, args, "--chmod=D755,F644")
+	require.Contains(t, args, "--delete", "the default flags are kept")
+	require.Equal(t, []string{"src/", "host:dest/"}, args[len(args)-2:])
+
+	err = runRsync("src/", "host:dest/", options{rsyncFlags: `--bwlimit="1000`}, nil)
+	require.Error(t, err)
+
+	tests := []struct {
+		name    string
+		o       options
+		want    []string
+		notWant []string
+	}{
+		{"default", options{}, []string{"-azr", "--delete"}, []string{"--dry-run", "--itemize-changes"}},
+		// Previews list every change, and what would be deleted.
+		{"preview", options{syncPreview: true}, []string{"--dry-run", "--itemize-changes", "-azvr", "--delete"}, nil},
+		{"resume", options{resumeSync: true}, []string{"--partial", "--partial-dir=" + rsyncPartialDir, "--delete"}, nil},
+		{"no resume", options{}, nil, []string{"--partial", "--partial-dir=" + rsyncPartialDir}},
+	}
+	for _, tt := range tests {
+		err = runRsync("src/", "host:dest/", tt.o, nil)
+		require.NoError(t, err, tt.name)
+		out, err := ioutil.ReadFile(argsPath)
+		require.NoError(t, err, tt.name)
+		args := strings.Split(strings.TrimSpace(string(out)), "\n")
+		for _, arg := range tt.want {
+			require.Contains(t, args, arg, tt.name)
+		}
+		for _, arg := range tt.notWant {
+			require.NotContains(t, args, arg, tt.name)
+		}
+	}
+}
+
+func TestSkipSyncCategories(t *testing.T) {
+	// Skipping both settings and extensions is skipping the sync, which
+	// leaves nothing to sync back.
+	err := sshCode("dev.kwc.io", "", options{skipSettings: true, skipExtensions: true, syncBackOnly: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--skipsync")
+
+	err = sshCode("dev.kwc.io", "", options{skipExtensions: true, extensions: []string{"golang.go"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--skip-extensions")
+}
+
+func TestInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		o    options
+		want string
+	}{
+		{"kept session on an assigned port", options{keepSession: true, remotePort: osAssignedPort}, "--keep-session"},
+		{"unknown sync direction", options{syncDirection: "sideways"}, "invalid sync direction"},
+		{"niceness too low", options{remoteNice: -21}, "invalid remote niceness"},
+		{"niceness too high", options{remoteNice: 20}, "invalid remote niceness"},
+		{"unknown I/O class", options{remoteIonice: "lazy"}, "invalid I/O scheduling class"},
+		{"previewing a skipped sync", options{syncPreview: true}, "no sync to preview"},
+		{"encryption without a key", options{encryptSettings: true}, "--gpg-recipient"},
+	}
+	for _, tt := range tests {
+		// Not syncing keeps a missing rsync from failing first.
+		tt.o.skipSync = true
+		err := sshCode("dev.kwc.io", "", tt.o)
+		require.Error(t, err, tt.name)
+		require.Contains(t, err.Error(), tt.want, tt.name)
+	}
+}
+
+func TestSyncsBack(t *testing.T) {
+	tests := []struct {
+		direction string
+		want      bool
+		wantErr   bool
+	}{
+		{"", false, false},
+		{syncPush, false, false},
+		{syncPull, false, false},
+		{syncBoth, true, false},
+		{"Push", false, true},
+		{"sideways", false, true},
+	}
+	for _, tt := range tests {
+		got, err := syncsBack(tt.direction)
+		if tt.wantErr {
+			require.Error(t, err, tt.direction)
+			continue
+		}
+		require.NoError(t, err, tt.direction)
+		require.Equal(t, tt.want, got, tt.direction)
+	}
+}
+
+func TestRemoteTestResult(t *testing.T) {
+	if !commandExists("sh") {
+		t.Skip("sh isn't installed")
+	}
+	exit := func(code int) error {
+		return exec.Command("sh", "-c", fmt.Sprintf("exit %v", code)).Run()
+	}
+
+	tests := []struct {
+		name    string
+		err     error
+		want    bool
+		wantErr bool
+	}{
+		{"installed", nil, true, false},
+		{"missing", exit(1), false, false},
+		{"connection failure", exit(sshConnectExitCode), false, true},
+		{"ssh not run", xerrors.New(`exec: "sh": executable file not found in $PATH`), false, true},
+	}
+	for _, tt := range tests {
+		got, err := remoteTestResult(tt.err)
+		require.Equal(t, tt.wantErr, err != nil, tt.name)
+		require.Equal(t, tt.want, got, tt.name)
+	}
+}
+
+func TestRsyncError(t *testing.T) {
+	if !commandExists("sh") {
+		t.Skip("sh isn't installed")
+	}
+	exit := func(code int) error {
+		return exec.Command("sh", "-c", fmt.Sprintf("exit %v", code)).Run()
+	}
+
+	require.NoError(t, rsyncError(nil))
+	require.NoError(t, rsyncError(exit(rsyncVanishedExitCode)), "vanished files are only a warning")
+
+	err := rsyncError(exit(23))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "partial transfer")
+	var exitErr *exec.ExitError
+	require.True(t, xerrors.As(err, &exitErr), "the exit error is kept")
+
+	err = rsyncError(exit(42))
+	require.Error(t, err)
+	require.Equal(t, "exit status 42", err.Error())
+}
+
+func TestOpenFileURL(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"main.go", `http://127.0.0.1:8443/?folder=%2Fhome%2Fkyle%2Fproj&payload=%5B%5B%22openFile%22%2C%22vscode-remote%3A%2F%2F127.0.0.1%3A8443%2Fhome%2Fkyle%2Fproj%2Fmain.go%22%5D%5D`},
+		{"./a b/../x.go", `http://127.0.0.1:8443/?folder=%2Fhome%2Fkyle%2Fproj&payload=%5B%5B%22openFile%22%2C%22vscode-remote%3A%2F%2F127.0.0.1%3A8443%2Fhome%2Fkyle%2Fproj%2Fx.go%22%5D%5D`},
+		{"proj.code-workspace", "http://127.0.0.1:8443/?workspace=%2Fhome%2Fkyle%2Fproj%2Fproj.code-workspace"},
+	}
+	for _, tt := range tests {
+		got, err := openFileURL("http://127.0.0.1:8443", "/home/kyle/proj", tt.file)
+		require.NoError(t, err, tt.file)
+		require.Equal(t, tt.want, got, tt.file)
+	}
+
+	for _, file := range []string{"/etc/passwd", "../other/main.go", "a/../..", "."} {
+		_, err := openFileURL("http://127.0.0.1:8443", "/home/kyle/proj", file)
+		require.Error(t, err, file)
+	}
+}
+
+func TestWaitForCodeServer(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// Still starting for the first few checks.
+		if requests <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != codeServerHealthPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	interrupted, err := waitForCodeServer(ctx, srv.Client(), srv.URL, 10*time.Millisecond, nil)
+	require.NoError(t, err)
+	require.False(t, interrupted)
+	mu.Lock()
+	require.Equal(t, 4, requests, "503s don't count as ready")
+	mu.Unlock()
+
+	// Versions without a health endpoint are ready once the page loads, or
+	// redirects to the login page.
+	for _, status := range []int{http.StatusOK, http.StatusFound} {
+		status := status
+		old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == codeServerHealthPath {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(status)
+		}))
+		client := old.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		require.NoError(t, checkCodeServerReady(context.Background(), client, old.URL), status)
+		old.Close()
+	}
+
+	var unavailableRequests int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&unavailableRequests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = waitForCodeServer(ctx, unavailable.Client(), unavailable.URL, 10*time.Millisecond, nil)
+	require.True(t, xerrors.Is(err, ErrStartupTimeout), "%v", err)
+	require.NotZero(t, atomic.LoadInt32(&unavailableRequests), "some check saw the 503")
+
+	interrupt := make(chan os.Signal, 1)
+	interrupt <- os.Interrupt
+	interrupted, err = waitForCodeServer(context.Background(), unavailable.Client(), unavailable.URL, time.Minute, interrupt)
+	require.NoError(t, err)
+	require.True(t, interrupted)
+}
+
+func TestWatchStopFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-stop")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stop")
+
+	done := make(chan struct{})
+	defer close(done)
+	stop := watchStopFile(path, 10*time.Millisecond, done)
+
+	select {
+	case <-stop:
+		t.Fatal("stopped without a stop file")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	select {
+	case <-stop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't stop once the stop file exists")
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, reconnectDelay(tt.attempt), "attempt %v", tt.attempt)
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	tests := []struct {
+		startupTimeout time.Duration
+		want           time.Duration
+	}{
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, time.Second},
+		{3 * time.Second, time.Second},
+		{30 * time.Second, 6 * time.Second},
+		{2 * time.Minute, 24 * time.Second},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, probeTimeout(tt.startupTimeout), tt.startupTimeout.String())
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		d       time.Duration
+		wantMax time.Duration
+	}{
+		{0, 0},
+		// Too short to lengthen by a quarter.
+		{3, 3},
+		{4, 4},
+		{250 * time.Millisecond, 250*time.Millisecond + 62500*time.Microsecond},
+		{time.Second, time.Second + 250*time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			got := jitter(tt.d)
+			require.True(t, got >= tt.d && got <= tt.wantMax, "jitter(%v) = %v", tt.d, got)
+		}
+	}
+}
+
+func TestReadinessClient(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	for _, env := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy", "NO_PROXY", "no_proxy"} {
+		value := proxy.URL
+		if strings.HasSuffix(strings.ToLower(env), "no_proxy") {
+			value = ""
+		}
+		old, ok := os.LookupEnv(env)
+		require.NoError(t, os.Setenv(env, value))
+		if ok {
+			defer os.Setenv(env, old)
+		} else {
+			defer os.Unsetenv(env)
+		}
+	}
+
+	var requests int32
+	ready := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(ready)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(ready)
+	defer tlsSrv.Close()
+
+	client := readinessClient(5*time.Second, false)
+	require.Nil(t, client.Transport.(*http.Transport).Proxy, "the environment's proxy isn't used")
+	require.NoError(t, checkCodeServerReady(context.Background(), client, srv.URL))
+	atomic.StoreInt32(&requests, 0)
+	require.NoError(t, checkCodeServerReady(context.Background(), client, tlsSrv.URL), "a self-signed certificate reached directly means code-server is up")
+	require.Zero(t, atomic.LoadInt32(&requests), "certificates are verified, so nothing is sent to the server")
+
+	client = readinessClient(5*time.Second, true)
+	// Go never proxies loopback addresses, so the servers above can't tell.
+	// The tunnel may be bound to other addresses, which it would.
+	require.Nil(t, client.Transport.(*http.Transport).Proxy, "the environment's proxy isn't used with --tls either")
+	require.NoError(t, checkCodeServerReady(context.Background(), client, tlsSrv.URL), "self-signed certificates are accepted")
+
+	require.Zero(t, atomic.LoadInt32(&proxied))
+}
+
+func TestVersionString(t *testing.T) {
+	got := versionString("v0.1.0", "abc1234", "2019-05-01T00:00:00Z")
+	require.True(t, strings.HasPrefix(got, "sshcode v0.1.0 (commit abc1234, built 2019-05-01T00:00:00Z, "), got)
+	require.True(t, strings.HasSuffix(got, runtime.GOOS+"/"+runtime.GOARCH+")"), got)
+}
+
+func TestPruneCommand(t *testing.T) {
+	tests := []struct {
+		codeServerPath string
+		want           string
+	}{
+		{
+			"~/.cache/sshcode/sshcode-server",
+			`find ~/.cache/sshcode -maxdepth 1 -type f -name "*-linux*" ! -samefile ~/.cache/sshcode/sshcode-server -print -delete`,
+		},
+		{
+			"/opt/sshcode/sshcode-server",
+			`find /opt/sshcode -maxdepth 1 -type f -name "*-linux*" ! -samefile /opt/sshcode/sshcode-server -print -delete`,
+		},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, pruneCommand(tt.codeServerPath), tt.codeServerPath)
+	}
+}
+
+func TestPruneCodeServerBinariesDryRun(t *testing.T) {
+	// With --dry-run, ssh isn't run, so the host doesn't need to exist.
+	err := pruneCodeServerBinaries("sshcode-test.invalid", options{dryRun: true, sshFlags: "-o ConnectTimeout=1"})
+	require.NoError(t, err)
+}
+
+func TestStartSSHMaster(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("master connections aren't supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "sshcode-master")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A fake ssh which logs how it's run, and keeps running as a master.
+	log := filepath.Join(dir, "log")
+	fakeSSH := `#!/bin/sh
+echo "$*" >> "` + log + `"
+case "$*" in
+*-MNq*) exec sleep 60 ;;
+esac
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(fakeSSH), 0755))
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	require.NoError(t, os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath))
+
+	flags, stop, err := startSSHMaster("-p 2222", "dev.kwc.io")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(flags, `-p 2222 -o "ControlPath=`), flags)
+	require.Contains(t, flags, "-o ControlMaster=auto -o ControlPersist="+sshControlPersist)
+
+	controlPath := strings.SplitN(strings.SplitN(flags, `ControlPath=`, 2)[1], `"`, 2)[0]
+	controlDir := filepath.Dir(controlPath)
+	info, err := os.Stat(controlDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm(), "only the user can reach the socket")
+
+	stop()
+	_, err = os.Stat(controlDir)
+	require.True(t, os.IsNotExist(err), "the control socket directory is removed")
+	calls, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	require.Contains(t, string(calls), `ControlPersist=`+sshControlPersist+" -O exit dev.kwc.io\n", "masters that took over are stopped")
+}
+
+func TestResync(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake rsync is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "sshcode-resync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The fake rsync records each run on a line, and fails if $RSYNC_EXIT is
+	// set.
+	log := filepath.Join(dir, "log")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %v\nexit ${RSYNC_EXIT:-0}\n", shellEscape(log))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rsync"), []byte(script), 0755))
+	for name, value := range map[string]string{
+		"PATH":                 dir + string(os.PathListSeparator) + os.Getenv("PATH"),
+		vsCodeConfigDirEnv:     filepath.Join(dir, "User"),
+		vsCodeExtensionsDirEnv: filepath.Join(dir, "extensions"),
+		"RSYNC_EXIT":           "",
+	} {
+		old, ok := os.LookupEnv(name)
+		require.NoError(t, os.Setenv(name, value))
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	// Empty directories aren't synced.
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "User"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "User", "settings.json"), []byte("{}"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "extensions", "golang.go-0.11.0"), 0755))
+
+	settingsDest := "dev.kwc.io:" + remoteDataPath("User/", options{})
+	extensionsDest := "dev.kwc.io:" + remoteDataPath("extensions/", options{})
+	tests := []struct {
+		name       string
+		o          options
+		settings   bool
+		extensions bool
+	}{
+		{"both", options{}, true, true},
+		{"settings only", options{skipExtensions: true}, true, false},
+		{"extensions only", options{skipSettings: true}, false, true},
+	}
+	for _, tt := range tests {
+		require.NoError(t, os.RemoveAll(log))
+		require.NoError(t, resync("dev.kwc.io", tt.o), tt.name)
+		calls, err := ioutil.ReadFile(log)
+		require.NoError(t, err, tt.name)
+		require.Equal(t, tt.settings, strings.Contains(string(calls), " "+settingsDest+"\n"), tt.name)
+		require.Equal(t, tt.extensions, strings.Contains(string(calls), " "+extensionsDest+"\n"), tt.name)
+	}
+
+	require.NoError(t, os.Setenv("RSYNC_EXIT", "12"))
+	err = resync("dev.kwc.io", options{})
+	require.True(t, xerrors.Is(err, ErrSyncSettings), "%v", err)
+	err = resync("dev.kwc.io", options{skipSettings: true})
+	require.True(t, xerrors.Is(err, ErrSyncExtensions), "%v", err)
+}
+
+func TestSettingsExcludes(t *testing.T) {
+	defaults := []string{"workspaceStorage", "logs", "CachedData"}
+	tests := []struct {
+		name string
+		o    options
+		want []string
+	}{
+		// Only the User dir's own tasks.json, not e.g. one in snippets/.
+		{"default", options{}, append(defaults, "/tasks.json")},
+		{"tasks", options{syncTasks: true}, defaults},
+		{"user excludes", options{syncTasks: true, syncExcludes: []string{"*.bak"}}, append(defaults, "*.bak")},
+		// Transferred encrypted instead.
+		{"encrypted", options{syncTasks: true, encryptSettings: true}, append(defaults, "/settings.json")},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, settingsExcludes(tt.o), tt.name)
+	}
+}
+
+func TestSyncEncryptedSettingsDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-encrypt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "settings.json"), []byte("{}"), 0600))
+
+	// Neither gpg nor the host are needed to only show what would happen.
+	for _, o := range []options{{dryRun: true}, {syncPreview: true}} {
+		o.encryptSettings, o.gpgRecipient = true, "kyle@kwc.io"
+		require.NoError(t, syncEncryptedSettings("sshcode-test.invalid", dir, "~/.local/share/code-server/User/", false, o))
+		require.NoError(t, syncEncryptedSettings("sshcode-test.invalid", dir, "~/.local/share/code-server/User/", true, o))
+	}
+	names, err := readDirNames(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"settings.json"}, names, "nothing is written")
+}
+
+func TestRsyncPaths(t *testing.T) {
+	if !commandExists("rsync") {
+		t.Skip("rsync is not installed")
+	}
+
+	local, err := ioutil.TempDir("", "sshcode-local")
+	require.NoError(t, err)
+	defer os.RemoveAll(local)
+	remote, err := ioutil.TempDir("", "sshcode-remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(remote)
+
+	write := func(path string, content string, mtime time.Time) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0640))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	read := func(path string) string {
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	// The remote copy being newer, e.g. due to clock skew, mustn't stop a
+	// local edit from being pushed.
+	write(filepath.Join(local, "keybindings.json"), `[{"key": "ctrl+k"}]`, time.Now().Add(-time.Hour))
+	write(filepath.Join(remote, "keybindings.json"), `[]`, time.Now())
+	write(filepath.Join(local, "other.json"), `{}`, time.Now())
+
+	err = rsyncPaths(local+"/", remote+"/", options{}, handEditedSettings...)
+	require.NoError(t, err)
+	require.Equal(t, `[{"key": "ctrl+k"}]`, read(filepath.Join(remote, "keybindings.json")))
+	require.False(t, pathExists(filepath.Join(remote, "other.json")), "only the given paths are synced")
+
+	// A snippet added remotely comes back when syncing back.
+	write(filepath.Join(remote, "snippets", "go.json"), `{"snippet": {}}`, time.Now())
+
+	err = rsyncPaths(remote+"/", local+"/", options{}, handEditedSettings...)
+	require.NoError(t, err)
+	require.Equal(t, `{"snippet": {}}`, read(filepath.Join(local, "snippets", "go.json")))
+	require.True(t, pathExists(filepath.Join(local, "other.json")), "other files are left alone")
+}
+
+func TestRunDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-dry-run")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	marker := filepath.Join(dir, "ran")
+	err = run(exec.Command("sh", "-l", "-c", "touch "+marker), options{dryRun: true})
+	require.NoError(t, err)
+	require.False(t, pathExists(marker), "commands don't run with --dry-run")
+
+	err = run(exec.Command("sh", "-l", "-c", "touch "+marker), options{})
+	require.NoError(t, err)
+	require.True(t, pathExists(marker))
+}
+
+func TestParseBindAddr(t *testing.T) {
+	tests := []struct {
+		in        string
+		localPort string
+		wantHost  string
+		wantPort  string
+	}{
+		{"", "", "127.0.0.1", ""},
+		{":8080", "", "127.0.0.1", "8080"},
+		{"0.0.0.0:8080", "", "0.0.0.0", "8080"},
+		{"[::1]:0", "", "::1", ""},
+		{"[::]:8080", "", "::", "8080"},
+		{"::1", "", "::1", ""},
+		{"[::1]", "", "::1", ""},
+		{"", "9000", "127.0.0.1", "9000"},
+		{"0.0.0.0", "9000", "0.0.0.0", "9000"},
+		{"[::1]", "9000", "::1", "9000"},
+		{":9000", "9000", "127.0.0.1", "9000"},
+	}
+	for _, tt := range tests {
+		got, err := parseBindAddr(tt.in, tt.localPort)
+		require.NoError(t, err, tt.in)
+
+		host, port, err := net.SplitHostPort(got)
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.wantHost, host, tt.in)
+		if tt.wantPort != "" {
+			require.Equal(t, tt.wantPort, port, tt.in)
+		} else {
+			require.NotEqual(t, "", port, tt.in)
+			require.NotEqual(t, "0", port, tt.in)
+		}
+	}
+
+	_, err := parseBindAddr(":8080", "9000")
+	require.Error(t, err, "conflicting local ports")
+	_, err = parseBindAddr("", "http")
+	require.Error(t, err)
+	_, err = parseBindAddr("", "70000")
+	require.Error(t, err)
+}
+
+func TestForwardSpec(t *testing.T) {
+	bindAddr, err := parseBindAddr("[::1]:8080", "")
+	require.NoError(t, err)
+	require.Equal(t, "[::1]:8080:localhost:41379", forwardSpec(bindAddr, "41379"))
+
+	bindAddr, err = parseBindAddr(":8080", "")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:8080:localhost:41379", forwardSpec(bindAddr, "41379"))
+}
+
+func TestStopCodeServerScript(t *testing.T) {
+	if !commandExists("pkill") {
+		t.Skip("pkill isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "sshcode-stop")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	flushed := filepath.Join(dir, "flushed")
+
+	port, err := randomPort()
+	require.NoError(t, err)
+
+	// The fake code-server writes its state on SIGTERM, like the real one
+	// flushing settings to disk.
+	fake := exec.Command("sh", "-c", `trap 'echo done > "$STATE"; exit 0' TERM; while :; do sleep 0.1; done`,
+		codeServerName, "--port="+port,
+	)
+	fake.Env = append(os.Environ(), "STATE="+flushed)
+	require.NoError(t, fake.Start())
+	exited := make(chan error, 1)
+	go func() {
+		exited <- fake.Wait()
+	}()
+
+	// Give the shell the chance to set up its trap.
+	time.Sleep(100 * time.Millisecond)
+
+	out, err := exec.Command("sh", "-c", stopCodeServerScript(port, 5*time.Second)).CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.Equal(t, "stopped\n", string(out))
+
+	select {
+	case err := <-exited:
+		require.NoError(t, err, "code-server should exit cleanly")
+	case <-time.After(time.Second):
+		t.Fatal("code-server didn't exit")
+	}
+	state, err := ioutil.ReadFile(flushed)
+	require.NoError(t, err)
+	require.Equal(t, "done\n", string(state))
+
+	// Nothing running is fine.
+	out, err = exec.Command("sh", "-c", stopCodeServerScript(port, 5*time.Second)).CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.Equal(t, "", string(out))
+}
+
+func TestMatchCodeServerCmd(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		port string
+		want string
+	}{
+		{"pgrep", "8443", `pgrep -u "$(id -u)" -f "[s]shcode-server.*--port=8443( |$)"`},
+		{"pkill -TERM", "", `pkill -TERM -u "$(id -u)" -f "[s]shcode-server.*--port="`},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, matchCodeServerCmd(tt.cmd, tt.port), tt.cmd)
+	}
+	require.Equal(t, matchCodeServerCmd("pkill", "8443")+" || true", killCodeServerCmd("8443"))
+	require.Contains(t, stopCodeServerScript("8443", time.Second), matchCodeServerCmd("pkill -KILL", "8443"))
+}
+
+func TestKillCodeServerCmd(t *testing.T) {
+	if !commandExists("pkill") {
+		t.Skip("pkill isn't installed")
+	}
+
+	port, err := randomPort()
+	require.NoError(t, err)
+
+	// fake starts a process which looks like a code-server started by sshcode
+	// on port.
+	fake := func(port string) chan error {
+		cmd := exec.Command("sh", "-c", "while :; do sleep 0.1; done", codeServerName, "--port="+port)
+		require.NoError(t, cmd.Start())
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+		return exited
+	}
+	target := fake(port)
+	// Another session, whose port starts like the target's.
+	other := fake(port + "0")
+	defer exec.Command("pkill", "-f", codeServerPattern(port+"0")).Run()
+
+	out, err := exec.Command("sh", "-c", killCodeServerCmd(port)).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	select {
+	case <-target:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the code-server on the port wasn't killed")
+	}
+	select {
+	case <-other:
+		t.Fatal("the code-server on another port was killed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	script := downloadScript("~/.cache/sshcode/sshcode-server", ".local/share/code-server", port, []string{"https://example.com/code-server"}, "", false)
+	require.Contains(t, script, killCodeServerCmd(port))
+	script = downloadScript("~/.cache/sshcode/sshcode-server", ".local/share/code-server", "", []string{"https://example.com/code-server"}, "", false)
+	require.NotContains(t, script, "pkill")
+}
+
+func TestExtraForwardSpecs(t *testing.T) {
+	specs, err := extraForwardSpecs([]string{"3000:3000", "9229", "8081:8080"}, "127.0.0.1:8443", "9000")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"127.0.0.1:3000:localhost:3000",
+		"127.0.0.1:9229:localhost:9229",
+		"127.0.0.1:8081:localhost:8080",
+	}, specs)
+
+	specs, err = extraForwardSpecs([]string{"3000"}, "[::1]:8443", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"[::1]:3000:localhost:3000"}, specs)
+
+	specs, err = extraForwardSpecs([]string{"3000"}, ":8080", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:3000:localhost:3000"}, specs)
+
+	specs, err = extraForwardSpecs([]string{"3000"}, "", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:3000:localhost:3000"}, specs)
+
+	for _, forwards := range [][]string{
+		{"3000:"},
+		{"http:3000"},
+		{"3000:70000"},
+		{"1:2:3"},
+		{"8443:3000"},
+		{"3000:9000"},
+		{"3000:3000", "3000:3001"},
+	} {
+		_, err := extraForwardSpecs(forwards, "127.0.0.1:8443", "9000")
+		require.Error(t, err, "%v", forwards)
+	}
+}
+
+func TestIsPrivilegedPort(t *testing.T) {
+	tests := []struct {
+		port string
+		want bool
+	}{
+		{"80", true},
+		{"443", true},
+		{"1023", true},
+		{"1024", false},
+		{"8443", false},
+		{"0", false},
+		{"", false},
+		{"http", false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, isPrivilegedPort(tt.port), tt.port)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.0.1.1:8080", true},
+		{"localhost:8080", true},
+		{"[::1]:8080", true},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"192.168.1.10:8080", false},
+		{"devbox:8080", false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, isLoopbackAddr(tt.addr), tt.addr)
+	}
+}
+
+func TestFreeRemotePortScript(t *testing.T) {
+	if !commandExists("ss") && !commandExists("netstat") {
+		t.Skip("neither ss nor netstat is installed")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, busyPort, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	freePort, err := randomPort()
+	require.NoError(t, err)
+
+	out, err := exec.Command("sh", "-c", freeRemotePortScript([]string{busyPort, freePort})).Output()
+	require.NoError(t, err)
+	require.Equal(t, freePort, strings.TrimSpace(string(out)))
+
+	err = exec.Command("sh", "-c", freeRemotePortScript([]string{busyPort})).Run()
+	require.Error(t, err, "there is no free port")
+
+	// Without ss and netstat, no port can be told to be free.
+	emptyDir, err := ioutil.TempDir("", "sshcode-path")
+	require.NoError(t, err)
+	defer os.RemoveAll(emptyDir)
+	cmd := exec.Command("/bin/sh", "-c", freeRemotePortScript([]string{freePort}))
+	cmd.Env = []string{"PATH=" + emptyDir}
+	out, err = cmd.Output()
+	exitErr, ok := err.(*exec.ExitError)
+	require.True(t, ok, "exits with an error: %v", err)
+	require.Equal(t, noPortListerExitCode, exitErr.ExitCode())
+	require.Empty(t, out)
+}
+
+func TestSessionError(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr bool
+	}{
+		{"clean exit", "exit 0", false},
+		{"crash", "exit 3", true},
+		{"ctrl-c on the remote host", "exit 130", false},
+		{"interrupted", "kill -INT $$", false},
+		{"terminated", "kill -TERM $$", false},
+		{"killed", "kill -KILL $$", true},
+	}
+	for _, tt := range tests {
+		// A fake session, in place of ssh running code-server.
+		cmd := exec.Command("sh", "-c", tt.script)
+		require.NoError(t, cmd.Start(), tt.name)
+		err := sessionError(cmd.Wait())
+		if tt.wantErr {
+			require.Error(t, err, tt.name)
+		} else {
+			require.NoError(t, err, tt.name)
+		}
+	}
+}
+
+func TestStartOnReadyHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-hook")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	hookCmd, err := startOnReadyHook(`echo "$SSHCODE_URL $SSHCODE_HOST" > `+shellEscape(out), "http://127.0.0.1:8443", "kyle@dev.kwc.io")
+	require.NoError(t, err)
+	require.NoError(t, hookCmd.Wait())
+
+	b, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "http://127.0.0.1:8443 kyle@dev.kwc.io\n", string(b))
+
+	hookCmd, err = startOnReadyHook("exit 1", "http://127.0.0.1:8443", "kyle@dev.kwc.io")
+	require.NoError(t, err)
+	require.Error(t, hookCmd.Wait())
+}
+
+func TestBrowserEnvCommand(t *testing.T) {
+	if !commandExists("sh") {
+		t.Skip("sh isn't installed")
+	}
+	const url = "http://127.0.0.1:8443"
+
+	dir, err := ioutil.TempDir("", "sshcode-browser")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// Like /mnt/c/Program Files/Google/Chrome/Application/chrome.exe on WSL.
+	browserPath := filepath.Join(dir, "Program Files", "chrome.exe")
+	require.NoError(t, os.MkdirAll(filepath.Dir(browserPath), 0750))
+	require.NoError(t, ioutil.WriteFile(browserPath, nil, 0750))
+
+	cmd := browserEnvCommand(browserPath, url)
+	require.Equal(t, []string{browserPath, url}, cmd.Args)
+
+	cmd = browserEnvCommand("open -a Firefox", url)
+	require.Equal(t, "open -a Firefox 'http://127.0.0.1:8443'", cmd.Args[len(cmd.Args)-1])
+
+	cmd = browserEnvCommand("firefox --new-tab %s --private", url)
+	require.Equal(t, "firefox --new-tab 'http://127.0.0.1:8443' --private", cmd.Args[len(cmd.Args)-1])
+}
+
+func TestIsWSLRelease(t *testing.T) {
+	require.True(t, isWSLRelease("4.4.0-19041-Microsoft\n"))
+	require.True(t, isWSLRelease("5.10.16.3-microsoft-standard-WSL2\n"))
+	require.False(t, isWSLRelease("5.15.0-91-generic\n"))
+}
+
+func TestChromeOptions(t *testing.T) {
+	const url = "http://127.0.0.1:8443"
+	tests := []struct {
+		name string
+		o    options
+		want []string
+	}{
+		{"default", options{}, []string{"--app=" + url, "--disable-extensions", "--disable-plugins", "--incognito"}},
+		{"no incognito", options{noIncognito: true}, []string{"--app=" + url, "--disable-extensions", "--disable-plugins"}},
+		{"extensions", options{allowExtensions: true}, []string{"--app=" + url, "--incognito"}},
+		{"both", options{noIncognito: true, allowExtensions: true}, []string{"--app=" + url}},
+		{
+			"profile", options{noIncognito: true, chromeProfileDir: "Profile 1"},
+			[]string{"--app=" + url, "--disable-extensions", "--disable-plugins", "--profile-directory=Profile 1"},
+		},
+		{
+			"profile in incognito", options{allowExtensions: true, chromeProfileDir: "Default"},
+			[]string{"--app=" + url, "--incognito", "--profile-directory=Default"},
+		},
+		{
+			"window name", options{noIncognito: true, allowExtensions: true, windowName: "sshcode-dev"},
+			[]string{"--app=" + url, "--class=sshcode-dev"},
+		},
+		{
+			"window name and profile", options{allowExtensions: true, chromeProfileDir: "Work", windowName: "work"},
+			[]string{"--app=" + url, "--incognito", "--profile-directory=Work", "--class=work"},
+		},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, chromeOptions(url, tt.o), tt.name)
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		in        string
+		wantHost  string
+		wantFlags string
+	}{
+		{"dev.kwc.io", "dev.kwc.io", ""},
+		{"kyle@dev.kwc.io", "kyle@dev.kwc.io", ""},
+		{"dev.kwc.io:2222", "dev.kwc.io", "-p 2222"},
+		{"kyle@dev.kwc.io:2222", "kyle@dev.kwc.io", "-p 2222"},
+		{"[::1]:2222", "::1", "-p 2222"},
+		{"kyle@[::1]", "kyle@::1", ""},
+		{"kyle@fe80::1", "kyle@fe80::1", ""},
+	}
+	for _, tt := range tests {
+		host, flags, err := parseHost(tt.in, options{})
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.wantHost, host, tt.in)
+		require.Equal(t, tt.wantFlags, flags, tt.in)
+	}
+
+	for _, in := range []string{"dev.kwc.io:ssh", "dev.kwc.io:70000", "[::1", "[::1]2222", "kyle@:2222"} {
+		_, _, err := parseHost(in, options{})
+		require.Error(t, err, in)
+	}
+}
+
+func TestCheckCloudCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-cli")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := os.Getenv("PATH")
+	require.NoError(t, os.Setenv("PATH", dir))
+	defer os.Setenv("PATH", path)
+
+	// An installed CLI, which the login shell may not find, is found on
+	// $PATH.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "doctl"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, checkCloudCLI("do:"))
+
+	err = checkCloudCLI("gcp:")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "gcloud")
+	require.Contains(t, err.Error(), cloudCLIs["gcp:"].installURL)
+
+	_, _, err = parseHost("aws:i-0123456789abcdef0", options{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), cloudCLIs["aws:"].installURL)
+}
+
+func TestWithUser(t *testing.T) {
+	tests := []struct {
+		host string
+		user string
+		want string
+	}{
+		{"dev.kwc.io", "", "dev.kwc.io"},
+		{"dev.kwc.io", "kyle", "kyle@dev.kwc.io"},
+		{" dev.kwc.io:2222", "kyle", "kyle@dev.kwc.io:2222"},
+		{"root@dev.kwc.io", "kyle", "root@dev.kwc.io"},
+		{"gcp:dev", "kyle", "gcp:kyle@dev"},
+		{"aws:i-0123456789abcdef0", "ubuntu", "aws:ubuntu@i-0123456789abcdef0"},
+		{"azure:group/vm", "azureuser", "azure:azureuser@group/vm"},
+		{"do:ubuntu@droplet", "kyle", "do:ubuntu@droplet"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, withUser(tt.host, tt.user), tt.host)
+	}
+}
+
+func TestSplitUser(t *testing.T) {
+	tests := []struct {
+		instance string
+		user     string
+		name     string
+	}{
+		{"i-0123456789abcdef0", "", "i-0123456789abcdef0"},
+		{"ubuntu@i-0123456789abcdef0", "ubuntu", "i-0123456789abcdef0"},
+		{"azureuser@group/vm", "azureuser", "group/vm"},
+		{"@droplet", "", "droplet"},
+	}
+	for _, tt := range tests {
+		user, name := splitUser(tt.instance)
+		require.Equal(t, tt.user, user, tt.instance)
+		require.Equal(t, tt.name, name, tt.instance)
+		// The user is joined back on its own, without a stray @.
+		require.Equal(t, strings.TrimPrefix(tt.instance, "@"), joinUser(user, name), tt.instance)
+	}
+}
+
+func TestIsEmptyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-empty")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	empty, err := isEmptyDir(dir)
+	require.NoError(t, err)
+	require.True(t, empty)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "settings.json"), []byte("{}"), 0600))
+	empty, err = isEmptyDir(dir)
+	require.NoError(t, err)
+	require.False(t, empty)
+
+	_, err = isEmptyDir(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+)
+
+// urlSpecScheme is the scheme of URLs describing a whole sshcode invocation.
+const urlSpecScheme = "sshcode"
+
+// isURLSpec reports whether the host argument is a URL spec.
+func isURLSpec(arg string) bool {
+	return strings.HasPrefix(arg, urlSpecScheme+"://")
+}
+
+// urlSpecOptions are the flags a URL spec may set. URLs are meant to be
+// shared, so options that run commands or change how ssh connects, such as
+// --ssh-flags or --on-ready, can't be set from one.
+var urlSpecOptions = map[string]bool{
+	"bind":            true,
+	"local-port":      true,
+	"remote-port":     true,
+	"skipsync":        true,
+	"skip-settings":   true,
+	"skip-extensions": true,
+	"sync-exclude":    true,
+	"no-open":         true,
+}
+
+// parseURLSpec parses a URL spec of the form
+// sshcode://[user@]host[:port][/dir][?flag=value&...] into the host and dir
+// arguments, the host keeping its port. Query parameters are set on fl as flags of the same name, unless
+// they were already given on the command line, which takes precedence. Only
+// the flags in urlSpecOptions are accepted.
+func parseURLSpec(spec string, fl *pflag.FlagSet) (host string, dir string, err error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != urlSpecScheme {
+		return "", "", xerrors.Errorf("unsupported scheme %q, expected %q", u.Scheme, urlSpecScheme)
+	}
+	if u.Hostname() == "" {
+		return "", "", xerrors.New("missing host")
+	}
+
+	// The port is left on the host, which parseHost turns into a -p flag,
+	// rather than added to --ssh-flags, which would stop the config file's
+	// from applying.
+	host = u.Host
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+
+	// A leading ~ is relative to the home directory, not to /.
+	dir = u.Path
+	if strings.HasPrefix(dir, "/~") {
+		dir = dir[1:]
+	}
+	if dir == "/" {
+		dir = ""
+	}
+
+	for name, values := range u.Query() {
+		if fl.Lookup(name) == nil {
+			return "", "", xerrors.Errorf("unknown option %q", name)
+		}
+		if !urlSpecOptions[name] {
+			return "", "", xerrors.Errorf("option %q can't be set from a URL, pass it as a flag instead", name)
+		}
+		if fl.Changed(name) {
+			continue
+		}
+		for _, v := range values {
+			err = fl.Set(name, v)
+			if err != nil {
+				return "", "", xerrors.Errorf("invalid value for option %q: %w", name, err)
+			}
+		}
+	}
+
+	return host, dir, nil
+}
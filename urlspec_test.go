@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURLSpec(t *testing.T) {
+	newFlags := func(args ...string) (*rootCmd, *pflag.FlagSet) {
+		var c rootCmd
+		fl := pflag.NewFlagSet("sshcode", pflag.ContinueOnError)
+		c.RegisterFlags(fl)
+		require.NoError(t, fl.Parse(args))
+		return &c, fl
+	}
+
+	c, fl := newFlags()
+	host, dir, err := parseURLSpec("sshcode://kyle@dev.kwc.io:2222/~/projects?bind=:8443&skipsync=true", fl)
+	require.NoError(t, err)
+	require.Equal(t, "kyle@dev.kwc.io:2222", host, "the port is left for parseHost")
+	require.Equal(t, "~/projects", dir)
+	require.Equal(t, ":8443", c.bindAddr)
+	require.True(t, c.skipSync)
+	require.False(t, fl.Changed("ssh-flags"), "the config file's ssh flags still apply")
+
+	parsed, sshFlags, err := parseHost(host, options{})
+	require.NoError(t, err)
+	require.Equal(t, "kyle@dev.kwc.io", parsed)
+	require.Equal(t, "-p 2222", sshFlags)
+
+	_, fl = newFlags()
+	host, _, err = parseURLSpec("sshcode://[::1]:2222", fl)
+	require.NoError(t, err)
+	require.Equal(t, "[::1]:2222", host)
+
+	c, fl = newFlags("--bind", ":9000")
+	host, dir, err = parseURLSpec("sshcode://dev.kwc.io/srv/app?bind=:8443", fl)
+	require.NoError(t, err)
+	require.Equal(t, "dev.kwc.io", host)
+	require.Equal(t, "/srv/app", dir)
+	require.Equal(t, ":9000", c.bindAddr, "command line flags take precedence")
+
+	_, fl = newFlags()
+	_, _, err = parseURLSpec("sshcode://dev.kwc.io?nope=1", fl)
+	require.Error(t, err)
+
+	for _, name := range []string{"ssh-flags", "open-browser-cmd", "on-ready", "code-server-flags", "upload-code-server", "config"} {
+		_, fl = newFlags()
+		_, _, err = parseURLSpec("sshcode://dev.kwc.io?"+name+"=x", fl)
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), "can't be set from a URL", name)
+	}
+
+	_, fl = newFlags()
+	_, _, err = parseURLSpec("sshcode:///dir", fl)
+	require.Error(t, err)
+}